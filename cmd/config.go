@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// Used for flags.
+	viewMerged bool
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configViewCmd)
+	configViewCmd.Flags().BoolVar(&viewMerged, "merged", false, "show the config with the system and team configs layered in, and where each value came from")
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the kube-lock config.",
+	Long: "kube-lock layers up to three configs, from the lowest:\n\n" +
+		"  1. the system config, " + systemConfigPath + "\n" +
+		"  2. the team config, from 'policyDir' in the system config or else " + policyDirEnv + " (a file, or a directory such as a git checkout whose YAML files are layered in name order)\n" +
+		"  3. your config, ~/.kube-lock.yaml (or --config)\n\n" +
+		"The settings of each layer replace those below it, and its contexts, profiles and tools replace those of the same name. " +
+		"Contexts and profiles marked 'enforced: true' can't be replaced by the layers above, so your config can't weaken them. " +
+		"Changes kube-lock makes (e.g. 'unlock') are only written to your config, and can't change or remove what is enforced or only in the layers below. " +
+		"Whether a context is locked or unlocked (and when it was unlocked) is your own, so you can still lock and unlock an enforced context, and only that is written to your config for it. " +
+		"Anything else, such as giving it another profile with 'set', is refused.\n\n" +
+		"A project can have its own " + projectConfigName + ", which is used for commands run from its directory or below (the nearest one above the working directory is used, other than your own config). " +
+		"It can only make kube-lock stricter: 'allowedContexts' pins the contexts (which can be patterns, e.g. 'payments-*') the project may use, " +
+		"and its 'blockedVerbs', 'rules' and 'flagRules' apply on top of the context's own profile, whatever the context's status.",
+}
+
+var configViewCmd = &cobra.Command{
+	Use:    "view",
+	Short:  "Show the kube-lock config.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := viewConfig(viewMerged)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// viewConfig prints the user's config, or the merged config annotated with the file each value came from
+func viewConfig(merged bool) error {
+	if !merged {
+		data, err := os.ReadFile(viper.ConfigFileUsed())
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(string(data))
+		return nil
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	var node yaml.Node
+	err = node.Encode(config)
+	if err != nil {
+		return err
+	}
+	annotateConfigSources(&node, config)
+
+	out, err := yaml.Marshal(&node)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(out))
+	return nil
+}
+
+// annotateConfigSources comments the settings, contexts, profiles and tools of the config with where they came from
+func annotateConfigSources(node *yaml.Node, config KubeLockConfig) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+		switch key {
+		case "contexts":
+			for j, item := range value.Content {
+				annotateItemSource(item, config.Contexts[j].Source, config.Contexts[j].Enforced)
+			}
+		case "profiles":
+			for j, item := range value.Content {
+				annotateItemSource(item, config.Profiles[j].Source, config.Profiles[j].Enforced)
+			}
+		case "tools":
+			for j, item := range value.Content {
+				annotateItemSource(item, config.Tools[j].Source, false)
+			}
+		default:
+			source, ok := config.Sources[key]
+			if !ok {
+				continue
+			}
+
+			// Comments on a list or mapping aren't printed, so they go on its key
+			if value.Kind == yaml.ScalarNode {
+				value.LineComment = "from " + source
+			} else {
+				node.Content[i].LineComment = "from " + source
+			}
+		}
+	}
+}
+
+// annotateItemSource comments the name of a context, profile or tool with where it came from
+func annotateItemSource(item *yaml.Node, source string, enforced bool) {
+	comment := "from " + source
+	if enforced {
+		comment += " (enforced)"
+	}
+
+	for i := 0; i+1 < len(item.Content); i += 2 {
+		if item.Content[i].Value == "name" {
+			item.Content[i+1].LineComment = comment
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"net/http"
+	"strings"
+)
+
+// dryRunFlag is added to commands that are only allowed as a dry-run. A server-side dry-run goes through admission
+// and validation like the real thing, so it fails the same way the command would.
+const dryRunFlag = "--dry-run=server"
+
+// getDryRunVerbs returns the verbs that can be run as a server-side dry-run
+func getDryRunVerbs() []string {
+	return []string{"apply", "create", "delete", "patch", "replace", "scale"}
+}
+
+// evaluateDryRun decides a command that is only allowed as a dry-run, refusing it if it can't be run as one
+func evaluateDryRun(req kubeLockRequest, reason string) kubeLockDecision {
+	if !contains(getDryRunVerbs(), req.Verb) {
+		return deny("%s '%s' can't be run as a dry-run (only '%s' can)!", reason, req.Verb, strings.Join(getDryRunVerbs(), "', '"))
+	}
+
+	return dryRun("%s", reason)
+}
+
+// dryRunArgs replaces any '--dry-run' in the arguments with a server-side dry-run
+func dryRunArgs(args []string) []string {
+	var out []string
+	for i, arg := range args {
+		// Everything after '--' is for the command being created (e.g. 'kubectl create job ... -- <command>')
+		if arg == "--" {
+			out = append(out, dryRunFlag)
+			return append(out, args[i:]...)
+		}
+
+		if arg == "--dry-run" || strings.HasPrefix(arg, "--dry-run=") {
+			continue
+		}
+		out = append(out, arg)
+	}
+
+	return append(out, dryRunFlag)
+}
+
+// dryRunHTTP makes a request that writes to the cluster a server-side dry-run
+func dryRunHTTP(r *http.Request) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("dryRun", "All")
+	r.URL.RawQuery = query.Encode()
+}
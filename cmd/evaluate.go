@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+const (
+	profileModeBlockList = "blockList"
+	profileModeAllowList = "allowList"
+)
+
+// kubeLockDecision is the outcome of evaluating a command against a profile.
+// A command that is allowed may still need the user to confirm it before it runs, or only be allowed as a dry-run.
+type kubeLockDecision struct {
+	Allowed bool
+	Confirm bool
+	DryRun  bool
+	Reason  string
+}
+
+func allow(format string, a ...interface{}) kubeLockDecision {
+	return kubeLockDecision{Allowed: true, Reason: fmt.Sprintf(format, a...)}
+}
+
+func deny(format string, a ...interface{}) kubeLockDecision {
+	return kubeLockDecision{Allowed: false, Reason: fmt.Sprintf(format, a...)}
+}
+
+func confirm(format string, a ...interface{}) kubeLockDecision {
+	return kubeLockDecision{Allowed: true, Confirm: true, Reason: fmt.Sprintf(format, a...)}
+}
+
+func dryRun(format string, a ...interface{}) kubeLockDecision {
+	return kubeLockDecision{Allowed: true, DryRun: true, Reason: fmt.Sprintf(format, a...)}
+}
+
+// profileMode returns the mode of a profile, defaulting to a block-list
+func profileMode(profile KubeLockProfiles) string {
+	if profile.Mode == "" {
+		return profileModeBlockList
+	}
+
+	return profile.Mode
+}
+
+// profileModeDescription describes the mode of a profile for messages
+func profileModeDescription(profile KubeLockProfiles) string {
+	if profileMode(profile) == profileModeAllowList {
+		return "allow-list mode"
+	}
+
+	return "block-list mode"
+}
+
+// matchGlobs checks if the value matches any of the shell patterns
+func matchGlobs(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// evaluateProfile decides whether the request is authorized by the profile.
+// Flag rules are evaluated first, then rules, and unless a rule blocks or allows the command the verb lists of the
+// profile's mode decide it.
+// Anything asking for confirmation (or for a dry-run) only does so if the command would otherwise be allowed.
+func evaluateProfile(profile KubeLockProfiles, req kubeLockRequest) (kubeLockDecision, error) {
+	var confirmations, dryRuns []string
+
+	flagDecision := evaluateFlagRules(profile, req)
+	if flagDecision != nil {
+		if !flagDecision.Allowed {
+			return *flagDecision, nil
+		} else if flagDecision.DryRun {
+			dryRuns = append(dryRuns, flagDecision.Reason)
+		} else {
+			confirmations = append(confirmations, flagDecision.Reason)
+		}
+	}
+
+	// A rule that allows the command decides it instead of the verb lists, but what the flag rules ask for still applies
+	var decision kubeLockDecision
+	ruleDecision, err := evaluateRules(profile, req)
+	if err != nil {
+		return kubeLockDecision{}, err
+	} else if ruleDecision != nil && !ruleDecision.Allowed {
+		return *ruleDecision, nil
+	} else if ruleDecision != nil && ruleDecision.DryRun {
+		dryRuns = append(dryRuns, ruleDecision.Reason)
+	} else if ruleDecision != nil && ruleDecision.Confirm {
+		confirmations = append(confirmations, ruleDecision.Reason)
+	} else if ruleDecision != nil {
+		decision = *ruleDecision
+	}
+
+	if !decision.Allowed {
+		decision, err = evaluateVerbs(profile, req)
+		if err != nil {
+			return kubeLockDecision{}, err
+		}
+	}
+
+	// A dry-run changes nothing, so there is nothing to confirm or count. Reading doesn't change anything either,
+	// so read-only commands run as they are.
+	if decision.Allowed && len(dryRuns) > 0 && !isReadOnlyRequest(req) {
+		return evaluateDryRun(req, strings.Join(dryRuns, " ")), nil
+	}
+
+	// The pre-flight reads from the cluster, so it is only worth running for commands that would otherwise be allowed
+	if decision.Allowed {
+		preflightDecision, err := evaluatePreflight(profile, req)
+		if err != nil {
+			return kubeLockDecision{}, err
+		} else if preflightDecision != nil && !preflightDecision.Allowed {
+			return *preflightDecision, nil
+		} else if preflightDecision != nil {
+			confirmations = append(confirmations, preflightDecision.Reason)
+		}
+	}
+
+	if decision.Allowed && len(confirmations) > 0 {
+		return confirm(strings.Join(confirmations, " ")), nil
+	}
+
+	return decision, nil
+}
+
+// kubeLockTarget is a resource type a command acts on, with the names of the objects of it the command names, if any
+type kubeLockTarget struct {
+	Resource string
+	Names    []string
+	// Labels are the labels of the object, when it comes from a manifest
+	Labels       map[string]string
+	FromManifest bool
+	// Unread is the manifest the objects are in when kube-lock can't read it (e.g. '-f -'), so their types aren't known
+	Unread string
+}
+
+// evaluateVerbs checks the verb (and every resource it targets, if any) against the verb lists of the profile's mode.
+// The command is only allowed if it is allowed for all of its resources.
+func evaluateVerbs(profile KubeLockProfiles, req kubeLockRequest) (kubeLockDecision, error) {
+	targets := requestTargets(req)
+	if len(targets) == 0 {
+		targets = []kubeLockTarget{{}}
+	}
+
+	var decision kubeLockDecision
+	for _, target := range targets {
+		var err error
+		switch profileMode(profile) {
+		case profileModeAllowList:
+			decision, err = evaluateAllowList(profile, req, target)
+		case profileModeBlockList:
+			decision, err = evaluateBlockList(profile, req, target)
+		default:
+			return kubeLockDecision{}, fmt.Errorf("profile '%s' has unknown mode '%s' (must be '%s' or '%s')", profile.Name, profile.Mode, profileModeBlockList, profileModeAllowList)
+		}
+
+		if err != nil || !decision.Allowed {
+			return decision, err
+		}
+	}
+
+	return decision, nil
+}
+
+// requestTargets returns the resource types the command targets. The objects in its manifests are used if it doesn't
+// name any, e.g. for 'kubectl delete -f', with their types qualified by group and version so they resolve exactly.
+// Manifests kube-lock can't read are targets of unknown type, so they are never mistaken for a command without any.
+func requestTargets(req kubeLockRequest) []kubeLockTarget {
+	var targets []kubeLockTarget
+	for _, resource := range req.Resources {
+		targets = append(targets, kubeLockTarget{Resource: resource, Names: req.Objects[resource]})
+	}
+	if len(targets) > 0 {
+		return targets
+	}
+
+	for _, object := range req.Manifests {
+		if target, ok := manifestTarget(object); ok {
+			targets = append(targets, target)
+		}
+	}
+	for _, manifest := range req.UnreadManifests {
+		targets = append(targets, kubeLockTarget{Unread: manifest})
+	}
+
+	return targets
+}
+
+// manifestTarget returns the target for an object in a manifest, with its name and labels
+func manifestTarget(object map[string]interface{}) (kubeLockTarget, bool) {
+	kind := toString(object["kind"])
+	gv, err := schema.ParseGroupVersion(toString(object["apiVersion"]))
+	if kind == "" || err != nil {
+		return kubeLockTarget{}, false
+	}
+
+	// In kubectl's 'resource.version.group' form, e.g. 'deployment.v1.apps', or 'pod.v1' for the core group
+	target := kubeLockTarget{Resource: strings.ToLower(kind) + "." + gv.Version, Labels: map[string]string{}, FromManifest: true}
+	if gv.Group != "" {
+		target.Resource += "." + gv.Group
+	}
+
+	metadata, _ := object["metadata"].(map[string]interface{})
+	if name := toString(metadata["name"]); name != "" {
+		target.Names = []string{name}
+	}
+	if objectLabels, ok := metadata["labels"].(map[string]interface{}); ok {
+		for k, v := range objectLabels {
+			target.Labels[k] = toString(v)
+		}
+	}
+
+	return target, true
+}
+
+func evaluateBlockList(profile KubeLockProfiles, req kubeLockRequest, target kubeLockTarget) (kubeLockDecision, error) {
+	verb := req.Verb
+	resource := target.Resource
+
+	// we must check if the verb should be blocked
+	if !contains(profile.BlockedVerbs, verb) {
+		return allow("verb '%s' is not blocked by Profile '%s' (block-list mode)!", verb, profile.Name), nil
+	} else if verb != "delete" {
+		return deny("Profile '%s' (block-list mode) is not authorized to '%s' resources!", profile.Name, verb), nil
+	}
+
+	// Finally, we must check if there is a delete exception for the delete command
+	log.Debug("Delete exceptions must be checked, continuing...")
+	if target.Unread != "" {
+		return deny("Delete exceptions in Profile '%s' (block-list mode) can't be checked for the objects in '%s', as kube-lock can't read it!", profile.Name, target.Unread), nil
+	}
+	ok, err := matchResourceRules(profile.DeleteExceptions, req, target)
+	if err != nil {
+		return kubeLockDecision{}, err
+	}
+
+	if ok {
+		return allow("Delete exceptions in Profile '%s' (block-list mode) allow for deleting '%s'!", profile.Name, resource), nil
+	}
+
+	return deny("Delete exceptions in Profile '%s' (block-list mode) do not allow for deleting '%s'!", profile.Name, resource), nil
+}
+
+func evaluateAllowList(profile KubeLockProfiles, req kubeLockRequest, target kubeLockTarget) (kubeLockDecision, error) {
+	verb := req.Verb
+	resource := target.Resource
+
+	if !contains(profile.AllowedVerbs, verb) {
+		return deny("Profile '%s' (allow-list mode) does not allow the verb '%s'!", profile.Name, verb), nil
+	}
+
+	// Objects kube-lock can't read might be of any type, so they can't be checked against the allowed resources
+	if len(profile.AllowedResources) > 0 && target.Unread != "" {
+		return deny("Profile '%s' (allow-list mode) can't check the objects in '%s' against its allowed resources, as kube-lock can't read it!", profile.Name, target.Unread), nil
+	}
+
+	// Verbs that don't address a resource type have nothing more to check
+	if resource == "" || len(profile.AllowedResources) == 0 {
+		return allow("verb '%s' is allowed by Profile '%s' (allow-list mode)!", verb, profile.Name), nil
+	}
+
+	ok, err := matchResourceRules(profile.AllowedResources, req, target)
+	if err != nil {
+		return kubeLockDecision{}, err
+	}
+
+	if ok {
+		return allow("verb '%s' on '%s' is allowed by Profile '%s' (allow-list mode)!", verb, resource, profile.Name), nil
+	}
+
+	return deny("Profile '%s' (allow-list mode) does not allow the verb '%s' on '%s'!", profile.Name, verb, resource), nil
+}
+
+// matchResourceRules checks if the target matches any of the group/resource rules. Resources that can't be resolved
+// never match, and are warned about, as a rule might have been meant to.
+func matchResourceRules(rules []KubeLockDeleteExceptions, req kubeLockRequest, target kubeLockTarget) (bool, error) {
+	if target.Unread != "" {
+		log.Warn("Unable to read '", target.Unread, "', so the objects in it can't match any rules.")
+		return false, nil
+	}
+
+	resource := target.Resource
+	resolved, ok, err := resolveResource(resource)
+	if err != nil {
+		log.Warn("Unable to resolve resource '", resource, "', so it can't match any rules: ", err)
+		return false, nil
+	} else if !ok {
+		log.Warn("Resource '", resource, "' is not known to kube-lock or served by the cluster, so it can't match any rules.")
+		return false, nil
+	}
+
+	for _, rule := range rules {
+		matched, err := resolved.matchesRule(rule)
+		if err != nil {
+			return false, err
+		}
+
+		if matched {
+			matched, err = matchObjectConstraints(rule, req, target, resolved)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if matched {
+			log.Debug("resource ", resource, " matches resource ", rule.Resource, " in group ", rule.Group)
+			return true, nil
+		}
+
+		log.Debug("Rule '", rule.Resource, "' in group '", rule.Group, "' does not match '", resource, "'...")
+	}
+
+	return false, nil
+}
+
+// matchObjectConstraints checks that every object the command targets is one the rule's 'names' and 'labelSelector'
+// allow. Commands that don't say which objects they target (e.g. with '--all') can't satisfy either.
+//
+// The label selector is satisfied by a '-l/--selector' on the command that requires everything it does, or the labels
+// in the manifest the object comes from. With 'verifyLabels', the objects the command names are fetched from the
+// cluster and their live labels are checked instead. A delete removes the live object, whatever labels the local
+// manifest says it has, so deleting from a manifest needs 'verifyLabels'.
+func matchObjectConstraints(rule KubeLockDeleteExceptions, req kubeLockRequest, target kubeLockTarget, resource kubeLockResource) (bool, error) {
+	if len(rule.Names) > 0 {
+		if len(target.Names) == 0 {
+			log.Debug("The command doesn't name the ", target.Resource, " it targets, so they can't be checked against '", strings.Join(rule.Names, "','"), "'")
+			return false, nil
+		}
+
+		for _, name := range target.Names {
+			if !matchGlobs(rule.Names, name) {
+				log.Debug(target.Resource, " '", name, "' doesn't match '", strings.Join(rule.Names, "','"), "'")
+				return false, nil
+			}
+		}
+	}
+
+	if rule.LabelSelector == "" {
+		return true, nil
+	}
+
+	selector, err := labels.Parse(rule.LabelSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid label selector '%s' for resource '%s': %w", rule.LabelSelector, rule.Resource, err)
+	}
+
+	if selectorImplies(req.Flags["selector"], selector) {
+		return true, nil
+	}
+
+	if rule.VerifyLabels && len(target.Names) > 0 {
+		return verifyObjectLabels(req, resource, target.Names, selector)
+	} else if target.FromManifest && req.Verb != "delete" {
+		return selector.Matches(labels.Set(target.Labels)), nil
+	} else if target.FromManifest {
+		log.Debug("The labels in the manifest aren't those of the live ", target.Resource, " the delete removes, so '", selector, "' can only be checked with 'verifyLabels'")
+		return false, nil
+	}
+
+	log.Debug("The command's selector '", req.Flags["selector"], "' doesn't require '", selector, "'")
+	return false, nil
+}
+
+// selectorImplies checks if the command's selector requires everything the rule's selector does, so every object it
+// selects is one the rule's would too
+func selectorImplies(commandSelector string, selector labels.Selector) bool {
+	if commandSelector == "" {
+		return false
+	}
+
+	command, err := labels.Parse(commandSelector)
+	if err != nil {
+		return false
+	}
+
+	commandRequirements, _ := command.Requirements()
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		found := false
+		for _, commandRequirement := range commandRequirements {
+			if sameRequirement(requirement, commandRequirement) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameRequirement checks if the label requirements are the same, treating '=' and '==' alike
+func sameRequirement(a labels.Requirement, b labels.Requirement) bool {
+	operator := func(op selection.Operator) selection.Operator {
+		if op == selection.DoubleEquals {
+			return selection.Equals
+		}
+		return op
+	}
+
+	return a.Key() == b.Key() && operator(a.Operator()) == operator(b.Operator()) && a.Values().Equal(b.Values())
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testManifest = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web-1
+  labels:
+    app: web
+`
+
+func TestMatchResourceRulesConstraints(t *testing.T) {
+	api := newFakeAPIServer(t)
+	setupTestConfig(t, api.Server, "contexts: []\n", "prod")
+
+	api.respond("/apis/apps/v1/namespaces/default/deployments/web-1", `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web-1","labels":{"app":"web"}}}`)
+	api.respond("/apis/apps/v1/namespaces/default/deployments/web-2", `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web-2","labels":{"app":"db"}}}`)
+	api.respond("/apis/apps/v1/namespaces/default/deployments/web-3", `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`)
+
+	manifest := filepath.Join(t.TempDir(), "web.yaml")
+	if err := os.WriteFile(manifest, []byte(testManifest), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	names := KubeLockDeleteExceptions{Group: "apps", Resource: "deployments", Names: []string{"web-*"}}
+	selector := KubeLockDeleteExceptions{Group: "apps", Resource: "deployments", LabelSelector: "app=web"}
+	verified := KubeLockDeleteExceptions{Group: "apps", Resource: "deployments", LabelSelector: "app=web", VerifyLabels: true}
+
+	tests := []struct {
+		name  string
+		rule  KubeLockDeleteExceptions
+		args  []string
+		match bool
+	}{
+		{name: "named objects match the name patterns", rule: names, args: []string{"delete", "deployment", "web-1", "web-2"}, match: true},
+		{name: "every named object must match", rule: names, args: []string{"delete", "deployment", "web-1", "db-1"}},
+		{name: "unnamed objects can't match the name patterns", rule: names, args: []string{"delete", "deployments", "--all"}},
+		{name: "type/name arguments", rule: names, args: []string{"delete", "deployment/web-1"}, match: true},
+		{name: "same selector", rule: selector, args: []string{"delete", "deployments", "-l", "app=web"}, match: true},
+		{name: "narrower selector", rule: selector, args: []string{"delete", "deployments", "-l", "app==web,tier=frontend"}, match: true},
+		{name: "other selector", rule: selector, args: []string{"delete", "deployments", "-l", "app=db"}},
+		{name: "wider selector", rule: selector, args: []string{"delete", "deployments", "-l", "app"}},
+		{name: "no selector", rule: selector, args: []string{"delete", "deployment", "web-1"}},
+		{name: "manifest labels", rule: selector, args: []string{"apply", "-f", manifest}, match: true},
+		{name: "deleting from a manifest needs verifyLabels", rule: selector, args: []string{"delete", "-f", manifest}},
+		{name: "deleting from a manifest with verifyLabels", rule: verified, args: []string{"delete", "-f", manifest}, match: true},
+		{name: "live labels match", rule: verified, args: []string{"delete", "deployment", "web-1"}, match: true},
+		{name: "live labels don't match", rule: verified, args: []string{"delete", "deployment", "web-1", "web-2"}},
+		{name: "missing object", rule: verified, args: []string{"delete", "deployment", "web-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseKubectlRequest(tt.args, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			targets := requestTargets(req)
+			if len(targets) == 0 {
+				t.Fatal("the command has no targets")
+			}
+
+			match := true
+			for _, target := range targets {
+				matched, err := matchResourceRules([]KubeLockDeleteExceptions{tt.rule}, req, target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				match = match && matched
+			}
+
+			if match != tt.match {
+				t.Fatalf("got match %v, want %v", match, tt.match)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseFlagSpec turns a flag from a rule (e.g. '--grace-period=0' or '-A') into the name it is parsed as,
+// and the value it must have (empty if any value matches)
+func parseFlagSpec(spec string) (string, string) {
+	name, value, _ := strings.Cut(spec, "=")
+	if strings.HasPrefix(name, "--") {
+		return strings.TrimPrefix(name, "--"), value
+	}
+
+	name = strings.TrimPrefix(name, "-")
+	if long, ok := getShortFlagNames()[name]; ok {
+		name = long
+	}
+
+	return name, value
+}
+
+// flagSet checks if a flag from a rule is set on the request
+func flagSet(flags map[string]string, spec string) bool {
+	name, value := parseFlagSpec(spec)
+	got, ok := flags[name]
+	if !ok {
+		return false
+	}
+
+	if value == "" {
+		return got != "false"
+	}
+
+	return got == value
+}
+
+// validateFlagRules checks that the flag rules in the config are usable, so mistakes are reported when the config is loaded
+func validateFlagRules(config KubeLockConfig) error {
+	for _, profile := range config.Profiles {
+		for i, rule := range profile.FlagRules {
+			if len(rule.Flags) == 0 {
+				return fmt.Errorf("flag rule #%d in profile '%s' has no flags", i+1, profile.Name)
+			}
+
+			action := ruleAction(rule.Action)
+			if action != ruleActionBlock && action != ruleActionConfirm && action != ruleActionDryRun {
+				return fmt.Errorf("flag rule #%d in profile '%s' has unknown action '%s' (must be '%s', '%s' or '%s')", i+1, profile.Name, rule.Action, ruleActionBlock, ruleActionConfirm, ruleActionDryRun)
+			}
+		}
+	}
+
+	return nil
+}
+
+// evaluateFlagRules checks the flags of the request against the flag rules of the profile.
+// A rule matches when every one of its flags is set, and the verb is one it is scoped to (if any).
+// Any matching 'block' rule blocks the command, otherwise any matching 'dryRun' rule only allows it as a dry-run, and
+// otherwise the first matching 'confirm' rule asks for confirmation.
+func evaluateFlagRules(profile KubeLockProfiles, req kubeLockRequest) *kubeLockDecision {
+	var decision *kubeLockDecision
+	for _, rule := range profile.FlagRules {
+		if len(rule.Verbs) > 0 && !contains(rule.Verbs, req.Verb) {
+			continue
+		}
+
+		matched := true
+		for _, spec := range rule.Flags {
+			if !flagSet(req.Flags, spec) {
+				matched = false
+				break
+			}
+		}
+
+		if !matched {
+			continue
+		}
+
+		flags := strings.Join(rule.Flags, " ")
+		if ruleAction(rule.Action) == ruleActionBlock {
+			d := deny("Profile '%s' does not allow the flag(s) '%s' with '%s'!", profile.Name, flags, req.Verb)
+			return &d
+		}
+
+		// A dry-run can't change anything, so it takes the place of any confirmation
+		if ruleAction(rule.Action) == ruleActionDryRun {
+			log.Debug("Flag(s) '", flags, "' are only allowed as a dry-run in Profile '", profile.Name, "'...")
+			if decision == nil || !decision.DryRun {
+				d := dryRun("Profile '%s' only allows the flag(s) '%s' with '%s' as a dry-run.", profile.Name, flags, req.Verb)
+				decision = &d
+			}
+			continue
+		}
+
+		log.Debug("Flag(s) '", flags, "' require confirmation in Profile '", profile.Name, "'...")
+		if decision == nil {
+			d := confirm("Profile '%s' requires confirmation for the flag(s) '%s' with '%s'.", profile.Name, flags, req.Verb)
+			decision = &d
+		}
+	}
+
+	return decision
+}
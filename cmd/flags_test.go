@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateFlagRules(t *testing.T) {
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "kubeconfig"))
+
+	profile := KubeLockProfiles{Name: "p", FlagRules: []KubeLockFlagRules{
+		{Flags: []string{"--grace-period=0", "--force"}},
+		{Flags: []string{"-A"}, Verbs: []string{"delete"}},
+		{Flags: []string{"--all"}, Action: ruleActionConfirm},
+		{Flags: []string{"--prune"}, Action: ruleActionDryRun},
+	}}
+
+	tests := []struct {
+		name string
+		args []string
+		want *kubeLockDecision
+	}{
+		{name: "every flag of a rule", args: []string{"delete", "pod", "foo", "--grace-period=0", "--force"}, want: &kubeLockDecision{}},
+		{name: "flag value with a space", args: []string{"delete", "pod", "foo", "--force", "--grace-period", "0"}, want: &kubeLockDecision{}},
+		{name: "only some flags of a rule", args: []string{"delete", "pod", "foo", "--force"}},
+		{name: "another flag value", args: []string{"delete", "pod", "foo", "--grace-period=30", "--force"}},
+		{name: "shorthand for the verb it is scoped to", args: []string{"delete", "pods", "-A", "-l", "app=web"}, want: &kubeLockDecision{}},
+		{name: "long form of the shorthand", args: []string{"delete", "pods", "--all-namespaces", "-l", "app=web"}, want: &kubeLockDecision{}},
+		{name: "scoped to another verb", args: []string{"get", "pods", "-A"}},
+		{name: "whatever the verb", args: []string{"label", "pods", "--all", "tier=web"}, want: &kubeLockDecision{Allowed: true, Confirm: true}},
+		{name: "set to false", args: []string{"delete", "pods", "--all=false", "foo"}},
+		{name: "dry-run in place of confirming", args: []string{"apply", "-f", "-", "--prune", "--all"}, want: &kubeLockDecision{Allowed: true, DryRun: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseKubectlRequest(tt.args, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := evaluateFlagRules(profile, req)
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("got decision %+v, want %+v", got, tt.want)
+			} else if got != nil && (got.Allowed != tt.want.Allowed || got.Confirm != tt.want.Confirm || got.DryRun != tt.want.DryRun) {
+				t.Fatalf("got decision %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFlagRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule KubeLockFlagRules
+		err  string
+	}{
+		{name: "valid", rule: KubeLockFlagRules{Flags: []string{"--force"}, Action: ruleActionConfirm}},
+		{name: "no flags", rule: KubeLockFlagRules{Action: ruleActionBlock}, err: "flag rule #1 in profile 'p' has no flags"},
+		{name: "allowing isn't an action", rule: KubeLockFlagRules{Flags: []string{"--force"}, Action: ruleActionAllow}, err: "has unknown action 'allow'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFlagRules(KubeLockConfig{Profiles: []KubeLockProfiles{{Name: "p", FlagRules: []KubeLockFlagRules{tt.rule}}}})
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
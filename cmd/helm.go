@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// KubeLockHelmExceptions allow helm verbs that a profile would otherwise block, for the releases and namespaces
+// matching the patterns. If resources are listed, every object the release renders must be one of them.
+type KubeLockHelmExceptions struct {
+	Verbs      []string                   `yaml:"verbs,omitempty"`
+	Releases   []string                   `yaml:"releases,omitempty"`
+	Namespaces []string                   `yaml:"namespaces,omitempty"`
+	Resources  []KubeLockDeleteExceptions `yaml:"resources,omitempty"`
+}
+
+// helmRequest is the structured form of a helm command that profiles are evaluated against
+type helmRequest struct {
+	Verb      string
+	Releases  []string
+	Revision  string
+	Namespace string
+	Flags     map[string]string
+	Args      []string
+}
+
+func getHelmBoolFlags() []string {
+	return []string{"--all", "--all-namespaces", "-A", "--atomic", "--cleanup-on-fail", "--create-namespace", "--debug", "--dependency-update", "--deployed", "--devel", "--disable-openapi-validation", "--dry-run", "--enable-dns", "--failed", "--force", "--generate-name", "-g", "--include-crds", "--insecure-skip-tls-verify", "--install", "-i", "--keep-history", "--no-hooks", "--pass-credentials", "--pending", "--plain-http", "--recreate-pods", "--render-subchart-notes", "--reset-then-reuse-values", "--reset-values", "--reuse-values", "--skip-crds", "--superseded", "--uninstalled", "--uninstalling", "--verify", "--wait", "--wait-for-jobs"}
+}
+
+func getHelmShortFlagNames() map[string]string {
+	return map[string]string{
+		"A": "all-namespaces",
+		"f": "values",
+		"g": "generate-name",
+		"i": "install",
+		"n": "namespace",
+		"o": "output",
+	}
+}
+
+// getHelmVerbAliases maps the aliases helm accepts to the verb profiles are written with
+func getHelmVerbAliases() map[string]string {
+	return map[string]string{
+		"del":    "uninstall",
+		"delete": "uninstall",
+		"un":     "uninstall",
+		"ls":     "list",
+		"hist":   "history",
+		"fetch":  "pull",
+	}
+}
+
+// getHelmWriteVerbs returns the helm verbs that change what is running in the cluster
+func getHelmWriteVerbs() []string {
+	return []string{"install", "rollback", "uninstall", "upgrade"}
+}
+
+// getHelmUpgradeOnlyFlags returns the flags of 'helm upgrade' that 'helm template' doesn't accept
+func getHelmUpgradeOnlyFlags() []string {
+	return []string{"install", "reuse-values", "reset-values", "reset-then-reuse-values", "force", "cleanup-on-fail", "recreate-pods", "history-max"}
+}
+
+func init() {
+	rootCmd.AddCommand(helmCmd)
+}
+
+var helmCmd = &cobra.Command{
+	Use:    "helm",
+	Short:  "The helm command you want to issue when using kube-lock",
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		ok, err := evaluateHelmContext(args)
+		if err != nil {
+			log.Fatal("Context evaluation failed: ", err)
+			os.Exit(1)
+		}
+		if ok {
+			execCommand("helm", args)
+		} else {
+			os.Exit(1)
+		}
+	},
+}
+
+func evaluateHelmContext(args []string) (bool, error) {
+	req := parseHelmRequest(args)
+
+	kubeContext, err := findHelmContext(req.Flags)
+	if err != nil {
+		return false, err
+	} else if kubeContext == "" {
+		log.Warn("No context found. Exiting.")
+		os.Exit(1)
+	}
+
+	if req.Namespace == "" {
+		req.Namespace = findHelmNamespace(req.Flags, kubeContext)
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return false, err
+	}
+
+	if !checkProjectContext(config.Project, kubeContext) {
+		return false, nil
+	}
+
+	status, unlockTimestamp, contextIndex, err := findContextInConfig(kubeContext, config)
+	if err != nil {
+		return false, err
+	}
+
+	profile, ok, err := checkContextStatus(kubeContext, status, unlockTimestamp, contextIndex, config)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return true, nil
+	}
+
+	decision, err := evaluateHelmProfile(profile, req)
+	if err != nil {
+		return false, err
+	}
+
+	return applyDecision(decision, kubeContext), nil
+}
+
+func parseHelmRequest(args []string) helmRequest {
+	req := helmRequest{Args: args}
+
+	var positional []string
+	req.Flags, positional = parseArgs(args, getHelmBoolFlags(), getHelmShortFlagNames())
+	req.Namespace = req.Flags["namespace"]
+
+	if len(positional) == 0 {
+		return req
+	}
+
+	req.Verb = positional[0]
+	if verb, ok := getHelmVerbAliases()[req.Verb]; ok {
+		req.Verb = verb
+	}
+	positional = positional[1:]
+
+	switch req.Verb {
+	case "install":
+		// 'helm install CHART --generate-name' has no release name yet
+		if len(positional) > 1 {
+			req.Releases = positional[:1]
+		}
+	case "uninstall":
+		req.Releases = positional
+	case "rollback":
+		if len(positional) > 1 {
+			req.Revision = positional[1]
+		}
+		req.Releases = positional[:min(len(positional), 1)]
+	case "get":
+		if len(positional) > 1 {
+			req.Releases = positional[1:2]
+		}
+	default:
+		req.Releases = positional[:min(len(positional), 1)]
+	}
+
+	return req
+}
+
+// findHelmContext finds the context helm will use, the same way helm does
+func findHelmContext(flags map[string]string) (string, error) {
+	return findToolContext(flags, []string{"--kube-context"}, []string{"--kubeconfig"}, []string{"HELM_KUBECONTEXT"})
+}
+
+// findHelmNamespace finds the namespace helm will use when it isn't set with '--namespace'
+func findHelmNamespace(flags map[string]string, kubeContext string) string {
+	if namespace := os.Getenv("HELM_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+
+	kubeConfig, err := kubeconfigLoadingRules(flags["kubeconfig"]).Load()
+	if err == nil {
+		if c, ok := kubeConfig.Contexts[kubeContext]; ok && c.Namespace != "" {
+			return c.Namespace
+		}
+	}
+
+	return "default"
+}
+
+// evaluateHelmProfile decides whether the helm command is authorized by the profile
+func evaluateHelmProfile(profile KubeLockProfiles, req helmRequest) (kubeLockDecision, error) {
+	var blocked bool
+	switch profileMode(profile) {
+	case profileModeAllowList:
+		blocked = !contains(profile.AllowedHelmVerbs, req.Verb)
+	case profileModeBlockList:
+		blocked = contains(profile.BlockedHelmVerbs, req.Verb)
+	default:
+		return kubeLockDecision{}, fmt.Errorf("profile '%s' has unknown mode '%s' (must be '%s' or '%s')", profile.Name, profile.Mode, profileModeBlockList, profileModeAllowList)
+	}
+
+	mode := profileModeDescription(profile)
+	if !blocked {
+		return allow("helm verb '%s' is authorized by Profile '%s' (%s)!", req.Verb, profile.Name, mode), nil
+	}
+
+	releases := strings.Join(req.Releases, "','")
+	var manifests []map[string]interface{}
+	for _, exception := range profile.HelmExceptions {
+		if !matchHelmException(exception, req) {
+			continue
+		}
+
+		if len(exception.Resources) > 0 {
+			if manifests == nil {
+				var err error
+				manifests, err = renderHelmManifests(req)
+				if err != nil {
+					log.Warn("Unable to render the manifests of the release to check them against the helm exceptions: ", err)
+					break
+				}
+			}
+
+			ok, err := matchManifestResources(manifests, exception.Resources)
+			if err != nil {
+				return kubeLockDecision{}, err
+			} else if !ok {
+				continue
+			}
+		}
+
+		return allow("Helm exceptions in Profile '%s' (%s) allow 'helm %s' for release '%s' in namespace '%s'!", profile.Name, mode, req.Verb, releases, req.Namespace), nil
+	}
+
+	return deny("Profile '%s' (%s) does not allow 'helm %s' for release '%s' in namespace '%s'!", profile.Name, mode, req.Verb, releases, req.Namespace), nil
+}
+
+// matchHelmException checks the verb, every release and the namespace of the request against the exception
+func matchHelmException(exception KubeLockHelmExceptions, req helmRequest) bool {
+	if len(exception.Verbs) > 0 && !contains(exception.Verbs, req.Verb) {
+		return false
+	}
+
+	if len(exception.Releases) > 0 {
+		// A release that hasn't been named yet can only match a pattern that matches anything
+		if len(req.Releases) == 0 && !matchGlobs(exception.Releases, "") {
+			return false
+		}
+		for _, release := range req.Releases {
+			if !matchGlobs(exception.Releases, release) {
+				return false
+			}
+		}
+	}
+
+	if len(exception.Namespaces) > 0 && !matchGlobs(exception.Namespaces, req.Namespace) {
+		return false
+	}
+
+	return true
+}
+
+// renderHelmManifests returns the objects the helm command would change: rendered with 'helm template' for installs
+// and upgrades, or the manifest of the release for uninstalls and rollbacks
+func renderHelmManifests(req helmRequest) ([]map[string]interface{}, error) {
+	var args []string
+	switch req.Verb {
+	case "install", "upgrade":
+		args = helmTemplateArgs(req)
+	case "uninstall":
+		if len(req.Releases) != 1 {
+			return nil, errors.New("manifests can only be checked when uninstalling one release at a time")
+		}
+		args = append([]string{"get", "manifest", req.Releases[0], "--namespace", req.Namespace}, helmConnectionArgs(req.Flags)...)
+	case "rollback":
+		if req.Revision == "" || len(req.Releases) != 1 {
+			return nil, errors.New("manifests can only be checked when rolling back to a given revision")
+		}
+		args = append([]string{"get", "manifest", req.Releases[0], "--revision", req.Revision, "--namespace", req.Namespace}, helmConnectionArgs(req.Flags)...)
+	default:
+		return nil, fmt.Errorf("manifests can't be checked for 'helm %s'", req.Verb)
+	}
+
+	log.Debug("Rendering manifests with 'helm ", strings.Join(args, " "), "'")
+	helmCmd := exec.Command("helm", args...)
+	helmCmd.Stderr = os.Stderr
+	out, err := helmCmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeManifests(out)
+}
+
+// helmTemplateArgs turns an install or upgrade into the equivalent 'helm template'
+func helmTemplateArgs(req helmRequest) []string {
+	upgradeOnly := getHelmUpgradeOnlyFlags()
+	shortFlags := getHelmShortFlagNames()
+	boolFlags := getHelmBoolFlags()
+
+	var args []string
+	replacedVerb := false
+	for i := 0; i < len(req.Args); i++ {
+		arg := req.Args[i]
+		if !looksLikeFlag(arg) {
+			if !replacedVerb {
+				arg = "template"
+				replacedVerb = true
+			}
+			args = append(args, arg)
+			continue
+		}
+
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if long, ok := shortFlags[name]; ok && !strings.HasPrefix(arg, "--") {
+			name = long
+		}
+		takesValue := !hasValue && !contains(boolFlags, arg) && i+1 < len(req.Args) && !looksLikeFlag(req.Args[i+1])
+
+		if contains(upgradeOnly, name) {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+
+		args = append(args, arg)
+		if takesValue {
+			args = append(args, req.Args[i+1])
+			i++
+		}
+	}
+
+	return args
+}
+
+// helmConnectionArgs returns the flags that decide which cluster helm talks to
+func helmConnectionArgs(flags map[string]string) []string {
+	var args []string
+	for _, flag := range []string{"kube-context", "kubeconfig"} {
+		if value := flags[flag]; value != "" {
+			args = append(args, "--"+flag, value)
+		}
+	}
+
+	return args
+}
+
+// matchManifestResources checks that every object is one of the resources
+func matchManifestResources(manifests []map[string]interface{}, resources []KubeLockDeleteExceptions) (bool, error) {
+	for _, object := range manifests {
+		apiVersion := toString(object["apiVersion"])
+		kind := toString(object["kind"])
+		resource, err := resourceForKind(apiVersion, kind)
+		if err != nil {
+			return false, err
+		}
+
+		target, _ := manifestTarget(object)
+		matched := false
+		for _, r := range resources {
+			matched, err = resource.matchesRule(r)
+			if err != nil {
+				return false, err
+			}
+
+			if matched {
+				// The rendered manifests are what helm will apply, so their labels are checked rather than the live objects'
+				r.VerifyLabels = false
+				matched, err = matchObjectConstraints(r, kubeLockRequest{Flags: map[string]string{}}, target, resource)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			if matched {
+				break
+			}
+		}
+
+		if !matched {
+			log.Debug("Rendered ", kind, " '", apiVersion, "' is not one of the resources allowed by the exception")
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// resourceForKind finds the resource of a kind from the catalogue or discovery, falling back to the usual
+// pluralisation of its name
+func resourceForKind(apiVersion string, kind string) (kubeLockResource, error) {
+	if resolved, ok, err := resolveKind(apiVersion, kind); err == nil && ok {
+		return resolved, nil
+	}
+
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return kubeLockResource{}, err
+	}
+
+	log.Debug("Unable to discover the resource for ", kind, " '", apiVersion, "', guessing its plural name")
+	resource := kubeLockResource{Kind: kind, Group: gv.Group, Versions: []string{gv.Version}}
+	name := strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(name, "s"):
+		resource.Name = name + "es"
+	case strings.HasSuffix(name, "y"):
+		resource.Name = strings.TrimSuffix(name, "y") + "ies"
+	default:
+		resource.Name = name + "s"
+	}
+
+	return resource, nil
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultImpersonateUser = "kube-lock:read-only"
+	readOnlyClusterRole    = "kube-lock-read-only"
+)
+
+// KubeLockImpersonate is the (low-privilege) identity that commands against a context are run as whenever it isn't
+// unlocked, so the cluster's RBAC enforces the lock too
+type KubeLockImpersonate struct {
+	User   string   `yaml:"user,omitempty"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+var (
+	// Used for flags.
+	rbacUser   string
+	rbacGroups []string
+)
+
+func init() {
+	rootCmd.AddCommand(rbacCmd)
+	rbacCmd.Flags().StringVar(&rbacUser, "user", "", "the user to grant read-only access to (default is the context's impersonate user, or '"+defaultImpersonateUser+"')")
+	rbacCmd.Flags().StringSliceVar(&rbacGroups, "group", nil, "the groups to grant read-only access to (default is the context's impersonate groups)")
+}
+
+var rbacCmd = &cobra.Command{
+	Use:   "rbac [context]",
+	Short: "Print the RBAC needed for the read-only identity that a context impersonates.",
+	Long: "Prints a ClusterRole that can only get, list and watch, and a ClusterRoleBinding granting it to the identity in the context's 'impersonate' settings. Apply it to the cluster with 'kubectl-lock rbac | kubectl apply -f -' while the context is unlocked.\n\n" +
+		"Like 'kubectl get', the role can read secrets. Bind the built-in 'view' ClusterRole instead if that is too much.\n" +
+		"The identity you normally use needs the 'impersonate' verb on users and groups, which cluster admins already have.",
+	Args:   cobra.MaximumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := printRBAC(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func printRBAC(args []string) error {
+	kubeContext := context
+	if len(args) > 0 {
+		kubeContext = args[0]
+	}
+	if kubeContext == "" {
+		var err error
+		kubeContext, err = findContext(args)
+		if err != nil {
+			return err
+		}
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	impersonate := KubeLockImpersonate{User: rbacUser, Groups: rbacGroups}
+	if impersonate.User == "" && len(impersonate.Groups) == 0 {
+		for _, c := range config.Contexts {
+			if c.Name == kubeContext && c.Impersonate != nil {
+				impersonate = *c.Impersonate
+			}
+		}
+	}
+	if impersonate.User == "" && len(impersonate.Groups) == 0 {
+		impersonate.User = defaultImpersonateUser
+	}
+
+	for i, object := range readOnlyRBAC(impersonate) {
+		out, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(out))
+	}
+
+	return nil
+}
+
+// readOnlyRBAC returns the ClusterRole and ClusterRoleBinding that give the identity read-only access
+func readOnlyRBAC(impersonate KubeLockImpersonate) []interface{} {
+	role := rbacv1.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: readOnlyClusterRole},
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"get", "list", "watch"}},
+			{NonResourceURLs: []string{"*"}, Verbs: []string{"get"}},
+		},
+	}
+
+	binding := rbacv1.ClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: readOnlyClusterRole},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: readOnlyClusterRole},
+	}
+	if impersonate.User != "" {
+		binding.Subjects = append(binding.Subjects, rbacv1.Subject{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: impersonate.User})
+	}
+	for _, group := range impersonate.Groups {
+		binding.Subjects = append(binding.Subjects, rbacv1.Subject{APIGroup: rbacv1.GroupName, Kind: rbacv1.GroupKind, Name: group})
+	}
+
+	return []interface{}{role, binding}
+}
+
+// findImpersonation returns the identity to impersonate for the context, or nil if it isn't set or the context is unlocked
+func findImpersonation(kubeContext string, config KubeLockConfig) *KubeLockImpersonate {
+	for _, c := range config.Contexts {
+		if c.Name != kubeContext {
+			continue
+		}
+
+		if c.Status == "unlocked" || c.Impersonate == nil || (c.Impersonate.User == "" && len(c.Impersonate.Groups) == 0) {
+			return nil
+		}
+		return c.Impersonate
+	}
+
+	return nil
+}
+
+// validateImpersonation checks that the identities contexts impersonate are usable, so mistakes are reported when the
+// config is loaded. Kubernetes only impersonates groups as part of impersonating a user.
+func validateImpersonation(config KubeLockConfig) error {
+	for _, c := range config.Contexts {
+		if c.Impersonate != nil && c.Impersonate.User == "" && len(c.Impersonate.Groups) > 0 {
+			return fmt.Errorf("context '%s' impersonates groups '%s' without a user, which Kubernetes doesn't allow (set 'user' too)", c.Name, strings.Join(c.Impersonate.Groups, "','"))
+		}
+	}
+
+	return nil
+}
+
+// String describes the identity for messages
+func (i KubeLockImpersonate) String() string {
+	if len(i.Groups) == 0 {
+		return i.User
+	}
+
+	return i.User + " (groups '" + strings.Join(i.Groups, "','") + "')"
+}
+
+// impersonationArgs returns the kubectl flags that impersonate the identity
+func impersonationArgs(impersonate *KubeLockImpersonate) []string {
+	var args []string
+	if impersonate.User != "" {
+		args = append(args, "--as="+impersonate.User)
+	}
+	for _, group := range impersonate.Groups {
+		args = append(args, "--as-group="+group)
+	}
+
+	return args
+}
+
+// impersonationOverridden checks if the user is trying to choose who to impersonate themselves
+func impersonationOverridden(flags map[string]string) bool {
+	for _, flag := range []string{"as", "as-group", "as-uid"} {
+		if _, ok := flags[flag]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyImpersonation sets the impersonation headers on a request through the proxy
+func applyImpersonation(header http.Header, impersonate *KubeLockImpersonate) {
+	if impersonate.User != "" {
+		header.Set("Impersonate-User", impersonate.User)
+	}
+	for _, group := range impersonate.Groups {
+		header.Add("Impersonate-Group", group)
+	}
+}
+
+// impersonationHeadersSet checks if the client is trying to choose who to impersonate itself
+func impersonationHeadersSet(header http.Header) bool {
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), "Impersonate-") {
+			return true
+		}
+	}
+
+	return false
+}
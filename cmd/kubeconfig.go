@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// originalKubeconfigEnv holds the kubeconfig the user had before 'lock --read-only' switched them to a read-only one
+const originalKubeconfigEnv = "KUBE_LOCK_ORIGINAL_KUBECONFIG"
+
+var (
+	// Used for flags.
+	kubeconfigReadOnly bool
+	kubeconfigOut      string
+)
+
+func init() {
+	rootCmd.AddCommand(kubeconfigCmd)
+	kubeconfigCmd.Flags().BoolVar(&kubeconfigReadOnly, "read-only", false, "only allow reading from the context, whatever its status")
+	kubeconfigCmd.Flags().StringVarP(&kubeconfigOut, "output", "o", "", "write the kubeconfig to a file instead of printing it")
+	kubeconfigCmd.Flags().StringVar(&proxyAddress, "address", "127.0.0.1", "the address the kube-lock proxy listens on")
+	kubeconfigCmd.Flags().IntVar(&proxyPort, "port", 8443, "the port the kube-lock proxy listens on")
+}
+
+var kubeconfigCmd = &cobra.Command{
+	Use:   "kubeconfig [context]",
+	Short: "Print a kubeconfig for a context that goes through the kube-lock proxy.",
+	Long: "Prints a kubeconfig for a context (the current one by default) that sends every request through the kube-lock proxy ('kubectl-lock proxy').\n\n" +
+		"With '--read-only', the proxy only allows reading from the context (get, describe, logs...), even when it is locked. " +
+		"The kubeconfig holds no credentials for the cluster, only a token the proxy accepts for reading alone, so no tool that uses it can write through it.\n\n" +
+		"The proxy's tokens change every time it starts, so the kubeconfig must be made again after it restarts.",
+	Args:   cobra.MaximumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := printKubeconfig(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func printKubeconfig(args []string) error {
+	kubeContext := context
+	if len(args) > 0 {
+		kubeContext = args[0]
+	}
+	if kubeContext == "" {
+		var err error
+		kubeContext, err = findContext(args)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := deriveKubeconfig(kubeContext, kubeconfigReadOnly)
+	if err != nil {
+		return err
+	}
+
+	if kubeconfigOut != "" {
+		return clientcmd.WriteToFile(*out, kubeconfigOut)
+	}
+
+	data, err := clientcmd.Write(*out)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(data))
+	return nil
+}
+
+// deriveKubeconfig returns a kubeconfig with just the context, pointing at the proxy
+func deriveKubeconfig(kubeContext string, readOnly bool) (*clientcmdapi.Config, error) {
+	rawConfig, err := loadOriginalKubeconfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c, ok := rawConfig.Contexts[kubeContext]
+	if !ok {
+		return nil, fmt.Errorf("context '%s' not found in kubeconfig", kubeContext)
+	}
+
+	certPEM, _, err := loadOrCreateProxyCert()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := readProxyToken(readOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	server := "https://" + net.JoinHostPort(proxyAddress, strconv.Itoa(proxyPort))
+	out := clientcmdapi.NewConfig()
+	addProxyContext(out, kubeContext, proxyServerForContext(server, kubeContext, readOnly), c.Namespace, certPEM, token)
+	out.CurrentContext = kubeContext
+
+	return out, nil
+}
+
+// findOriginalKubeconfig returns the user's own kubeconfig, even if they have switched to a read-only one
+func findOriginalKubeconfig() string {
+	if kubeConfigPath, ok := os.LookupEnv(originalKubeconfigEnv); ok {
+		return kubeConfigPath
+	}
+
+	return os.Getenv("KUBECONFIG")
+}
+
+// loadOriginalKubeconfig loads the user's own kubeconfig the way kubectl would, merging the files if there are several
+func loadOriginalKubeconfig() (*clientcmdapi.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.Precedence = []string{clientcmd.RecommendedHomeFile}
+	if original := findOriginalKubeconfig(); original != "" {
+		rules.Precedence = filepath.SplitList(original)
+	}
+
+	return rules.Load()
+}
+
+func readOnlyKubeconfigPath(kubeContext string) (string, error) {
+	dir, err := getProxyDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "read-only", url.PathEscape(kubeContext)+".yaml"), nil
+}
+
+// usingReadOnlyKubeconfig checks if the user has been switched to the read-only kubeconfig of the context
+func usingReadOnlyKubeconfig(kubeContext string) bool {
+	path, err := readOnlyKubeconfigPath(kubeContext)
+	if err != nil {
+		return false
+	}
+
+	return os.Getenv("KUBECONFIG") == path
+}
+
+// switchToReadOnlyKubeconfig writes the read-only kubeconfig of the context, and prints the commands that switch the
+// user's shell to it (for 'eval "$(kubectl-lock lock --read-only)"')
+func switchToReadOnlyKubeconfig(kubeContext string) error {
+	out, err := deriveKubeconfig(kubeContext, true)
+	if err != nil {
+		return err
+	}
+
+	path, err := readOnlyKubeconfigPath(kubeContext)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = clientcmd.WriteToFile(*out, path)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Switching to the read-only kubeconfig for context '", kubeContext, "'. Reads go through the kube-lock proxy, so make sure 'kubectl-lock proxy' is running.")
+	if _, ok := os.LookupEnv(originalKubeconfigEnv); !ok {
+		fmt.Printf("export %s=%q\n", originalKubeconfigEnv, os.Getenv("KUBECONFIG"))
+	}
+	fmt.Printf("export KUBECONFIG=%q\n", path)
+
+	return nil
+}
+
+// warnReadOnlyKubeconfig reminds the user to switch back to their own kubeconfig, as the read-only one can't write
+func warnReadOnlyKubeconfig() {
+	original, ok := os.LookupEnv(originalKubeconfigEnv)
+	if !ok {
+		return
+	}
+
+	command := fmt.Sprintf("export KUBECONFIG=%q", original)
+	if original == "" {
+		command = "unset KUBECONFIG"
+	}
+	log.Warn("Your shell is still using a read-only kubeconfig. Switch back to your own with: ", command, "; unset ", originalKubeconfigEnv)
+}
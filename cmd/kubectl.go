@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -18,34 +20,158 @@ import (
 
 const (
 	timestampLayout = "2006-01-02T15:04:05Z07:00"
+	// kubectlEnv overrides the kubectl binary kube-lock runs, e.g. 'oc' or a kubectl matching the cluster's version
+	kubectlEnv = "KUBE_LOCK_KUBECTL"
+	// discoveryCacheTTL is how long discovery is cached for, which is the same as kubectl
+	discoveryCacheTTL = 6 * time.Hour
 )
 
+// errNoContext is returned when the command doesn't set a context, and the kubeconfig has no current context
+var errNoContext = errors.New("no context found")
+
+// illegalCacheDirCharacters matches the characters kubectl replaces in the host when naming its discovery cache
+var illegalCacheDirCharacters = regexp.MustCompile(`[^(\w/.)]`)
+
 func getDeleteBoolFlags() []string {
 	return []string{"--all", "--all-namespaces", "--force", "--ignore-not-found", "--now", "--recursive", "-R", "--wait"}
 }
 
+// getBoolFlags returns the flags that never take a value, so the argument after them must not be skipped. They are
+// kubectl's bool flags, global and of every command, and the flags with a value for when none is given (e.g.
+// '--dry-run' and '--cascade'). A flag missing from here takes the argument after it as its value, which would hide
+// the verb or resource from the profile, so it must be kept complete.
+func getBoolFlags() []string {
+	global := []string{"--disable-compression", "--insecure-skip-tls-verify", "--match-server-version", "--warnings-as-errors"}
+	printing := []string{"--allow-missing-template-keys", "--no-headers", "--output-watch-events", "--server-print", "--show-kind", "--show-labels", "--show-managed-fields", "-w", "--watch", "--watch-only"}
+	optionalValue := []string{"--cascade", "--dry-run", "--validate"}
+	commands := []string{
+		"-A", "--append-hash", "--append-server-path", "--as-current-user", "--attach", "--cached", "--client", "--command",
+		"--current", "--delete-emptydir-data", "--delete-local-data", "--disable-eviction", "--disable-filter",
+		"--edit", "--embed-certs", "--enable-alpha-plugins", "--enable-exec", "--enable-helm", "--expose", "--flatten",
+		"--force-conflicts", "--ignore-daemonsets", "--ignore-errors", "-i", "--stdin", "--interactive",
+		"--insecure-skip-tls-verify-backend", "--keep-annotations", "--keep-init-containers", "--keep-labels",
+		"--keep-liveness", "--keep-readiness", "--keep-startup", "--leave-stdin-open", "--list", "--local", "--merge",
+		"--minify", "--name-only", "--namespaced", "--network", "--no-preserve", "--openapi-patch", "--output-patch",
+		"--overwrite", "--prefix", "--privileged", "--prune", "-q", "--quiet", "--record", "--remove-extra-permissions",
+		"--remove-extra-subjects", "--replace", "--resolve", "--rm", "--same-node", "--save-config", "--server-side",
+		"--set-raw-bytes", "--share-processes", "--short", "--show-capacity", "--show-events", "--sum", "-t", "--tty",
+		"--timestamps", "--use-protocol-buffers", "--windows-line-endings",
+	}
+
+	flags := append(getDeleteBoolFlags(), global...)
+	flags = append(flags, printing...)
+	flags = append(flags, optionalValue...)
+	return append(flags, commands...)
+}
+
+// getVerbFlags returns the bool flags and shorthand flags of a verb whose shorthands mean something else for it than
+// for the rest of kubectl, e.g. 'kubectl logs -f' follows the logs rather than reading a file
+func getVerbFlags(verb string) ([]string, map[string]string, bool) {
+	switch verb {
+	case "logs":
+		shortFlags := getShortFlagNames()
+		shortFlags["f"] = "follow"
+		shortFlags["p"] = "previous"
+		return append(getBoolFlags(), "-f", "--follow", "-p", "--previous", "--all-containers"), shortFlags, true
+	}
+
+	return nil, nil, false
+}
+
+// getContextFreeVerbs returns the kubectl commands that never talk to a cluster, so can be run without a context
+func getContextFreeVerbs() []string {
+	return []string{"completion", "config", "help", "kustomize", "options", "plugin"}
+}
+
+// getCompletionCommands returns the hidden commands kubectl's shell completion runs
+func getCompletionCommands() []string {
+	return []string{"__complete", "__completeNoDesc"}
+}
+
+// getResourceVerbs returns the verbs that take a resource type as their first argument (after the subcommand, for
+// 'rollout' and 'set')
+func getResourceVerbs() []string {
+	return []string{"annotate", "autoscale", "delete", "describe", "edit", "expose", "get", "label", "patch", "rollout", "scale", "set", "taint", "wait"}
+}
+
 type KubeLockConfig struct {
 	Contexts            []KubeLockContexts `yaml:"contexts"`
 	Profiles            []KubeLockProfiles `yaml:"profiles"`
 	DefaultProfile      string             `yaml:"defaultProfile"`
 	UnlockTimeoutPeriod string             `yaml:"unlockTimeoutPeriod"`
+	Tools               []KubeLockTools    `yaml:"tools,omitempty"`
+	KubectlPath         string             `yaml:"kubectlPath,omitempty"`
+	// Project is the config of the project the command is run from, which is never read from or written to this config
+	Project *KubeLockProject `yaml:"project,omitempty" mapstructure:"-"`
+	// TrustedPolicyKeys are the public keys the team config must be signed with. They are only read from the system config.
+	TrustedPolicyKeys []string `yaml:"trustedPolicyKeys,omitempty"`
+	// PolicyDir is where the team config is, in place of KUBE_LOCK_POLICY_DIR. It is only read from the system config.
+	PolicyDir string `yaml:"policyDir,omitempty"`
+	// Sources are the config files the top-level settings came from, by key
+	Sources map[string]string `yaml:"-" mapstructure:"-"`
 }
 
 type KubeLockContexts struct {
-	Name            string `yaml:"name"`
-	Status          string `yaml:"status"`
-	UnlockTimestamp string `yaml:"unlockTimestamp"`
+	Name            string               `yaml:"name"`
+	Status          string               `yaml:"status"`
+	UnlockTimestamp string               `yaml:"unlockTimestamp"`
+	Impersonate     *KubeLockImpersonate `yaml:"impersonate,omitempty"`
+	KubectlPath     string               `yaml:"kubectlPath,omitempty"`
+	// Enforced contexts in the system or team config can't be changed by the layers above them
+	Enforced bool   `yaml:"enforced,omitempty"`
+	Source   string `yaml:"-" mapstructure:"-"`
 }
 
 type KubeLockProfiles struct {
-	Name             string                     `yaml:"name"`
-	BlockedVerbs     []string                   `yaml:"blockedVerbs"`
-	DeleteExceptions []KubeLockDeleteExceptions `yaml:"deleteExceptions"`
+	Name                   string                     `yaml:"name"`
+	Extends                []string                   `yaml:"extends,omitempty"`
+	Override               []string                   `yaml:"override,omitempty"`
+	Mode                   string                     `yaml:"mode,omitempty"`
+	AllowedVerbs           []string                   `yaml:"allowedVerbs,omitempty"`
+	AllowedResources       []KubeLockDeleteExceptions `yaml:"allowedResources,omitempty"`
+	BlockedVerbs           []string                   `yaml:"blockedVerbs"`
+	RemoveBlockedVerbs     []string                   `yaml:"removeBlockedVerbs,omitempty"`
+	DeleteExceptions       []KubeLockDeleteExceptions `yaml:"deleteExceptions"`
+	RemoveDeleteExceptions []KubeLockDeleteExceptions `yaml:"removeDeleteExceptions,omitempty"`
+	Rules                  []KubeLockRules            `yaml:"rules,omitempty"`
+	FlagRules              []KubeLockFlagRules        `yaml:"flagRules,omitempty"`
+	BlockedHelmVerbs       []string                   `yaml:"blockedHelmVerbs,omitempty"`
+	AllowedHelmVerbs       []string                   `yaml:"allowedHelmVerbs,omitempty"`
+	HelmExceptions         []KubeLockHelmExceptions   `yaml:"helmExceptions,omitempty"`
+	PreflightRules         []KubeLockPreflightRules   `yaml:"preflightRules,omitempty"`
+	// PreviewDiff shows what every command with manifests would change (as 'kubectl diff' does) before it runs, and
+	// checks the objects it would change against the profile, as is done for commands that need confirming
+	PreviewDiff bool `yaml:"previewDiff,omitempty"`
+	// Enforced profiles in the system or team config can't be changed by the layers above them
+	Enforced bool   `yaml:"enforced,omitempty"`
+	Source   string `yaml:"-" mapstructure:"-"`
+}
+
+// KubeLockFlagRules block (or ask for confirmation of) commands that set all of the flags, optionally only for some verbs.
+// Flags can require a value, e.g. '--grace-period=0'.
+type KubeLockFlagRules struct {
+	Flags  []string `yaml:"flags"`
+	Verbs  []string `yaml:"verbs,omitempty"`
+	Action string   `yaml:"action,omitempty"`
 }
 
+// KubeLockRules are CEL expressions evaluated against the 'request' the user is making.
+// The first rule whose expression is true decides whether the command is blocked or allowed.
+type KubeLockRules struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	Action     string `yaml:"action,omitempty"`
+	Message    string `yaml:"message,omitempty"`
+}
+
+// KubeLockDeleteExceptions match a group and resource, which can be patterns. They can be narrowed down to objects
+// whose names match 'names', or that 'labelSelector' selects.
 type KubeLockDeleteExceptions struct {
-	Group    string `yaml:"group"`
-	Resource string `yaml:"resource"`
+	Group         string   `yaml:"group"`
+	Resource      string   `yaml:"resource"`
+	Names         []string `yaml:"names,omitempty"`
+	LabelSelector string   `yaml:"labelSelector,omitempty"`
+	VerifyLabels  bool     `yaml:"verifyLabels,omitempty"`
 }
 
 func init() {
@@ -57,87 +183,252 @@ var kubectlCmd = &cobra.Command{
 	Short:  "The kubectl command you want to issue when using kube-lock",
 	PreRun: toggleDebug,
 	Run: func(cmd *cobra.Command, args []string) {
-		ok, err := evaluateContext(cmd, args)
+		args, ok, err := evaluateContext(cmd, args)
 		if err != nil {
 			log.Fatal("Context evaluation failed: ", err)
 			os.Exit(1)
 		}
 		if ok {
 			execKubectl(cmd, args)
+		} else {
+			os.Exit(1)
 		}
 	},
 }
 
+// findContextArg returns the context the command sets with '--context', in any of the forms kubectl accepts
 func findContextArg(args []string) string {
-	var context string
-	for i := range args {
-		if args[i] == "--context" {
-			context = args[i+1]
-		}
-	}
+	return findKubectlFlag(args, "context")
+}
 
-	return context
+// findKubectlFlag returns the value of one of kubectl's flags in the arguments (the last one, if it is repeated)
+func findKubectlFlag(args []string, name string) string {
+	flags, _ := parseArgs(args, getBoolFlags(), getShortFlagNames())
+	values := strings.Split(flags[name], ",")
+	return values[len(values)-1]
 }
 
-func findContextConfig() (string, error) {
-	configPath := os.Getenv("KUBECONFIG")
+// kubeconfigLoadingRules returns the rules kubectl loads its kubeconfig with: the file given with '--kubeconfig' if
+// there is one, otherwise the files in KUBECONFIG merged together, or ~/.kube/config if it isn't set
+func kubeconfigLoadingRules(kubeconfig string) *clientcmd.ClientConfigLoadingRules {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	return rules
+}
 
-	kubeConfig, err := clientcmd.LoadFromFile(configPath)
+// findContextConfig returns the current context of the kubeconfig, or of the one kubectl uses by default if it is empty
+func findContextConfig(kubeconfig string) (string, error) {
+	kubeConfig, err := kubeconfigLoadingRules(kubeconfig).Load()
 	if err != nil {
 		return "", err
 	}
 	return kubeConfig.CurrentContext, nil
 }
 
+// findContext returns the context the command addresses, which is set with '--context' or is the current context of
+// the kubeconfig. It returns errNoContext if there is neither.
 func findContext(args []string) (string, error) {
 	// First we want to evaluate if the user has specified a context
 	kubeContext := findContextArg(args)
 	if kubeContext != "" {
 		return kubeContext, nil
-	} else {
-		var err error
-		kubeContext, err = findContextConfig()
-		if err != nil {
-			return kubeContext, err
-		} else if kubeContext == "" {
-			log.Warn("No context found. Exiting.")
-			os.Exit(1)
-		}
+	}
+
+	kubeContext, err := findContextConfig(findKubectlFlag(args, "kubeconfig"))
+	if err != nil {
+		return "", err
+	} else if kubeContext == "" {
+		return "", errNoContext
 	}
 
 	return kubeContext, nil
 }
 
-func evaluateContext(cmd *cobra.Command, args []string) (bool, error) {
+// needsContext checks if the kubectl command talks to a cluster, rather than only to the local machine (e.g.
+// 'kubectl config use-context' or 'kubectl version --client')
+func needsContext(args []string) bool {
+	flags, positional := parseArgs(args, getBoolFlags(), getShortFlagNames())
+	if len(positional) == 0 {
+		return false
+	}
+
+	switch verb := positional[0]; {
+	case contains(getContextFreeVerbs(), verb):
+		return false
+	case verb == "version":
+		return !flagSet(flags, "--client")
+	}
+
+	return true
+}
+
+// evaluateContext decides whether the kubectl command may run against its context, and returns the arguments to run
+// it with (which impersonate a low-privilege identity if the context is set up to)
+func evaluateContext(cmd *cobra.Command, args []string) ([]string, bool, error) {
+	// Shell completion runs kubectl in the background, so it must never be blocked or asked to confirm
+	if len(args) > 0 && contains(getCompletionCommands(), args[0]) {
+		return args, true, nil
+	}
+
+	// Commands that only change the local machine (e.g. 'kubectl config use-context') don't reach any cluster, so they
+	// run whatever the status of the context is, even if it is locked or there isn't one
+	if !needsContext(args) {
+		log.Debug("The command doesn't talk to a cluster, so the status of the context doesn't apply. Proceed...")
+		return args, true, nil
+	}
+
 	// Finding the current context set
 	kubeContext, err := findContext(args)
-	if err != nil {
-		return false, err
+	if errors.Is(err, errNoContext) {
+		log.Error("Halt! No context is set, so kube-lock can't tell which cluster the command is for. Set one with '--context' or 'kubectl config use-context'. Exiting...")
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
 	}
+	currentDiscoveryTarget = discoveryTarget{Context: kubeContext, Kubeconfig: findKubectlFlag(args, "kubeconfig")}
 
 	// Getting the kube-lock config from viper
 	config, err := getViperConfig()
 	if err != nil {
-		return false, err
+		return nil, false, err
 	}
 
 	status, unlockTimestamp, contextIndex, err := findContextInConfig(kubeContext, config)
 	if err != nil {
-		return false, err
+		return nil, false, err
 	}
 
 	if len(args) > 0 {
 		if args[0] == "lock" {
-			return true, nil
+			return args, true, nil
+		}
+	}
+
+	if !checkProjectContext(config.Project, kubeContext) {
+		return nil, false, nil
+	}
+
+	// Contexts that impersonate a low-privilege identity when they aren't unlocked leave it to the cluster to
+	// enforce the lock, rather than blocking everything
+	impersonate := findImpersonation(kubeContext, config)
+	if impersonate != nil {
+		flags, _ := parseArgs(args, getBoolFlags(), getShortFlagNames())
+		if impersonationOverridden(flags) {
+			log.Error("Halt! Context '", kubeContext, "' impersonates '", impersonate, "' while it isn't unlocked, which can't be overridden. Exiting...")
+			return nil, false, nil
 		}
+		log.Debug("Impersonating '", impersonate, "' for context '", kubeContext, "'...")
+
+		if (status == "" || status == "locked") && config.Project == nil {
+			return append(impersonationArgs(impersonate), args...), true, nil
+		} else if status == "" || status == "locked" {
+			req, err := parseKubectlRequest(args, kubeContext)
+			if err != nil {
+				return nil, false, err
+			}
+
+			profiles, decision, err := evaluateProject(config.Project, req, nil, allow("Context '%s' impersonates a low-privilege identity!", kubeContext))
+			if err != nil {
+				return nil, false, err
+			}
+
+			return applyKubectlDecision(profiles, req, append(impersonationArgs(impersonate), args...), decision, kubeContext)
+		}
+	}
+
+	profile, ok, err := checkContextStatus(kubeContext, status, unlockTimestamp, contextIndex, config)
+	if err != nil {
+		return nil, false, err
+	} else if !ok && config.Project == nil {
+		return args, true, nil
+	}
+
+	// Parse the kubectl command issued by the user into something the profile can be evaluated against
+	req, err := parseKubectlRequest(args, kubeContext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var profiles []KubeLockProfiles
+	decision := allow("Context '%s' is unlocked!", kubeContext)
+	if ok {
+		profiles = append(profiles, profile)
+		decision, err = evaluateProfile(profile, req)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// A project's config applies on top of the context's own, whatever its status
+	profiles, decision, err = evaluateProject(config.Project, req, profiles, decision)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if impersonate != nil {
+		args = append(impersonationArgs(impersonate), args...)
+	}
+
+	return applyKubectlDecision(profiles, req, args, decision, kubeContext)
+}
+
+// applyKubectlDecision applies the decision of the profiles to the kubectl command, and returns the arguments to run
+// it with and whether it may run
+func applyKubectlDecision(profiles []KubeLockProfiles, req kubeLockRequest, args []string, decision kubeLockDecision, kubeContext string) ([]string, bool, error) {
+	// Show what the command would change before asking to confirm it (or before running it, for profiles that always
+	// preview), which also makes sure it only changes what the profiles allow
+	if decision.Allowed && !decision.DryRun && (decision.Confirm || previewsDiff(profiles)) {
+		var err error
+		decision, err = evaluateDiffPreview(profiles, req, args, decision)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	ok := applyDecision(decision, kubeContext)
+	if ok && decision.DryRun {
+		// The dry-run itself only prints the objects it would have changed
+		if _, _, err := runDiffPreview(req, args); err != nil {
+			log.Warn("Unable to show the diff: ", err)
+		}
+		args = dryRunArgs(args)
+	}
+
+	return args, ok, nil
+}
+
+// applyDecision reports the decision to the user (asking for confirmation if it needs it), and returns whether the command may run.
+// A command that is only allowed as a dry-run may run, once it has been made one.
+func applyDecision(decision kubeLockDecision, kubeContext string) bool {
+	if !decision.Allowed {
+		log.Error("Halt! ", decision.Reason, " Exiting...")
+		return false
 	}
 
+	if decision.DryRun {
+		log.Warn(decision.Reason, " Context '", kubeContext, "' is in dry-run mode, so the command is run with '", dryRunFlag, "' and nothing will be changed.")
+		return true
+	}
+
+	if decision.Confirm {
+		log.Warn(decision.Reason)
+		yesNo("Warning: Are you sure you would like to run this command against context '" + kubeContext + "'?")
+		return true
+	}
+
+	log.Debug(decision.Reason, " Proceed...")
+	return true
+}
+
+// checkContextStatus exits if the context is 'locked' (or its unlock has expired), and otherwise returns the profile
+// that commands must be evaluated against. The bool returned is false if the context is 'unlocked'.
+func checkContextStatus(kubeContext string, status string, unlockTimestamp string, contextIndex int, config KubeLockConfig) (KubeLockProfiles, bool, error) {
 	// Exit now if status is 'unlocked' or 'locked'
 	if status == "unlocked" {
 		if config.UnlockTimeoutPeriod != "" {
 			ok, err := checkIfUnlockExpired(unlockTimestamp, kubeContext, contextIndex, config)
 			if err != nil {
-				return false, err
+				return KubeLockProfiles{}, false, err
 			} else if !ok {
 				log.Error("Halt! Unlock for Context '", kubeContext, "' has expired (times out after ", config.UnlockTimeoutPeriod, "). Setting status of context back to 'locked' and exiting...")
 				setContextStatus(kubeContext, contextIndex, "locked", config)
@@ -145,75 +436,35 @@ func evaluateContext(cmd *cobra.Command, args []string) (bool, error) {
 			}
 		}
 		log.Debug("Your context is unlocked! Proceed...", status)
-		return true, nil
+		return KubeLockProfiles{}, false, nil
+	} else if status == "locked" && usingReadOnlyKubeconfig(kubeContext) {
+		log.Debug("Your context is locked, but you are using its read-only kubeconfig...")
+		return getReadOnlyProfile(), true, nil
 	} else if status == "locked" {
 		log.Error("Halt! Your context is locked! Exiting...")
 		os.Exit(1)
 	}
 
 	// Checking status has an associated profile
-	ok, blockedVerbs, deleteExceptions := validateProfileInConfig(status, config)
-	if !ok {
-		log.Error("Profile '", status, "' not found. Please add it, or change Profile for context '", kubeContext, "'.")
-		os.Exit(1)
-	}
-
-	// Find the verb and resource strings from the kubectl command issued by the user
-	var verb string
-	var resource string
-	verb, resource, err = findArgs(args)
+	profile, ok, err := validateProfileInConfig(status, config)
 	if err != nil {
-		return false, err
-	}
-
-	// we must check if the verb should be blocked
-	if !contains(blockedVerbs, verb) {
-		log.Debug("verb '", verb, "' is authorized with Profile ", status, "! Proceed...", status)
-		return true, nil
-	} else if verb == "delete" {
-		log.Debug("Delete exceptions must be checked, continuing...")
-	} else {
-		log.Error("Halt! Your context has status '", status, "' which is not authorized to '", verb, "' resources! Exiting...")
+		return KubeLockProfiles{}, false, err
+	} else if !ok {
+		log.Error("Profile '", status, "' not found. Please add it, or change Profile for context '", kubeContext, "'.")
 		os.Exit(1)
 	}
 
-	// Finally, we must check if there is a delete exception for the delete command
-	kubeconfig := os.Getenv("KUBECONFIG")
-	for _, exception := range deleteExceptions {
-		exists, err := findResourceTypeFromDiscovery(kubeconfig, resource, exception)
-		if err != nil {
-			log.Debug("There's a problem with the discovery api")
-			return false, err
-		}
-
-		if exists {
-			log.Debug("Delete exceptions in Profile '", status, "' allows for deleting '", resource, "'! Proceeding...")
-			return true, nil
-		} else {
-			log.Debug("Delete exception '", exception.Resource, "' does not match any resources in group '", exception.Group, "'...")
-		}
-	}
-
-	log.Error("Halt! Delete exceptions in Profile '", status, "' does not allow for deleting '", resource, "'! Exiting...")
-	return false, nil
+	return profile, true, nil
 }
 
 // Execute the kubectl command
 func execKubectl(cmd *cobra.Command, args []string) {
-	kubectlCmd := exec.Command("kubectl", args...)
-	kubectlCmd.Stdin = os.Stdin
-	kubectlCmd.Stdout = os.Stdout
-	kubectlCmd.Stderr = os.Stderr
-
-	err := kubectlCmd.Start()
+	kubectlPath, err := findKubectlForArgs(args)
 	if err != nil {
-		os.Exit(err.(*exec.ExitError).ExitCode())
+		log.Fatal(err)
 	}
 
-	err = kubectlCmd.Wait()
-	if err != nil {
-		os.Exit(err.(*exec.ExitError).ExitCode())
-	}
+	execCommand(kubectlPath, args)
 }
 
 // contains checks if a string is present in a slice
@@ -227,62 +478,19 @@ func contains(s []string, str string) bool {
 	return false
 }
 
-// Manipulated from https://github.com/spf13/cobra/blob/bfacc59f62c67ffd43e93655a8d933cefab0fa99/command.go#L685 to find the flags and skip them
-func findArgs(args []string) (string, string, error) {
-	skipLoop := false
-	var verb string
-	var resource string
-
-	delBoolFlags := getDeleteBoolFlags()
-
-	for _, arg := range args {
-		switch {
-		// The next loop must be skipped
-		case skipLoop:
-			skipLoop = false
-			continue
-		// Checking for delete bool flags
-		case verb != "" && contains(delBoolFlags, arg):
-			log.Debug(arg, " is a delete bool flag, and should be skipped")
-			continue
-		// A long flag with a space separated value
-		case strings.HasPrefix(arg, "--") && !strings.Contains(arg, "="):
-			log.Debug(arg, " is a flag with a space separator, skipping the next string and continuing")
-			skipLoop = true
-			continue
-		// A short flag with a space separated value
-		case strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && len(arg) == 2:
-			log.Debug(arg, " is a flag with a space separator, skipping the next string and continuing")
-			skipLoop = true
-			continue
-		case isFlagArg(arg):
-			log.Debug(arg, " is a flag with a '=' separator, continuing")
-			continue
-		}
-
-		if verb == "" {
-			verb = arg
-			if verb != "delete" {
-				log.Debug("verb '", verb, "' is not the verb 'delete' and so we are not looking for further rules")
-				break
-			} else {
-				continue
-			}
-		} else if resource == "" {
-			resource = arg
-			break
-		}
+// There might be a good way of doing this with viper, but this will do for now
+// Only what differs from the system and team configs is written to the user's config, as they are layered under it
+func WriteToConfig(config KubeLockConfig) error {
+	layers, err := findLowerConfigLayers()
+	if err != nil {
+		return err
 	}
-	return verb, resource, nil
-}
 
-func isFlagArg(arg string) bool {
-	return ((len(arg) >= 3 && arg[1] == '-') ||
-		(len(arg) >= 2 && arg[0] == '-' && arg[1] != '-'))
-}
+	config, err = userConfigLayer(config, mergeConfigLayers(layers), viper.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
 
-// There might be a good way of doing this with viper, but this will do for now
-func WriteToConfig(config KubeLockConfig) error {
 	newConfig, err := yaml.Marshal(&config)
 	if err != nil {
 		return err
@@ -295,6 +503,8 @@ func WriteToConfig(config KubeLockConfig) error {
 	return nil
 }
 
+// getViperConfig returns the config kube-lock uses, which is the user's config layered onto the system and team configs,
+// with the config of the project the command is run from
 func getViperConfig() (KubeLockConfig, error) {
 	config := KubeLockConfig{}
 	err := viper.Unmarshal(&config)
@@ -302,6 +512,19 @@ func getViperConfig() (KubeLockConfig, error) {
 		return config, err
 	}
 
+	layers, err := findLowerConfigLayers()
+	if err != nil {
+		return config, err
+	}
+
+	config = mergeConfigLayers(append(layers, kubeLockConfigLayer{Source: viper.ConfigFileUsed(), Config: config}))
+	config.Project, err = readProjectConfig()
+	if err != nil {
+		return config, err
+	} else if config.Project != nil {
+		config.Sources["project"] = config.Project.Source
+	}
+
 	return config, nil
 }
 
@@ -327,7 +550,7 @@ func findContextInConfig(kubeContext string, config KubeLockConfig) (string, str
 		if config.DefaultProfile == "" {
 			log.Debug("Ensuring defaults are setup if not already:")
 			config.DefaultProfile = "protected"
-			config.Profiles = append(config.Profiles, KubeLockProfiles{Name: "protected", BlockedVerbs: []string{"delete", "apply", "create", "patch", "label", "annotate", "replace", "cp", "taint", "drain", "uncordon", "cordon", "auto-scale", "scale", "rollout", "expose", "run", "set"}, DeleteExceptions: []KubeLockDeleteExceptions{{Group: "cert-manager.io/v1", Resource: "certificates"}, {Group: "v1", Resource: "pods"}}})
+			config.Profiles = append(config.Profiles, KubeLockProfiles{Name: "protected", BlockedVerbs: []string{"delete", "apply", "create", "patch", "label", "annotate", "replace", "cp", "taint", "drain", "uncordon", "cordon", "auto-scale", "scale", "rollout", "expose", "run", "set"}, BlockedHelmVerbs: getHelmWriteVerbs(), DeleteExceptions: []KubeLockDeleteExceptions{{Group: "cert-manager.io", Resource: "certificates"}, {Group: "", Resource: "pods"}}})
 			err := WriteToConfig(config)
 			if err != nil {
 				return "", "", 0, err
@@ -352,43 +575,41 @@ func findContextInConfig(kubeContext string, config KubeLockConfig) (string, str
 	return status, unlockTimestamp, contextIndex, nil
 }
 
-func findResourceTypeFromDiscovery(kubeConfig string, resource string, exception KubeLockDeleteExceptions) (bool, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
-	if err != nil {
-		log.Debug("Couldn't get kubeconfig")
-		return false, err
+// newDiscoveryClient returns a discovery client for the context's cluster that caches on disk where kubectl does, so
+// they share the cache
+func newDiscoveryClient(target discoveryTarget) (*discovery.CachedDiscoveryClient, error) {
+	config, ok := discoveryConfigs[target.Context]
+	if !ok || target.Kubeconfig != "" {
+		var err error
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			kubeconfigLoadingRules(target.Kubeconfig),
+			&clientcmd.ConfigOverrides{CurrentContext: target.Context},
+		).ClientConfig()
+		if err != nil {
+			log.Debug("Couldn't get kubeconfig")
+			return nil, err
+		}
 	}
-	// Mate wtf sort this out
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		log.Debug("Could not find home directory")
-		err := fmt.Errorf("Could not find user home directory:")
-		return false, err
-	}
-	discoveryClient, err := discovery.NewCachedDiscoveryClientForConfig(config, fmt.Sprintf("%s/.kube/cache/discovery", homeDir), "", time.Duration(10*time.Millisecond))
-	if err != nil {
-		log.Debug("Couldn't create new discovery client with config")
-		return false, err
+		return nil, fmt.Errorf("could not find user home directory: %w", err)
 	}
 
-	resourceList, err := discoveryClient.ServerResourcesForGroupVersion(exception.Group)
+	cacheDir := filepath.Join(homeDir, ".kube", "cache")
+	discoveryClient, err := discovery.NewCachedDiscoveryClientForConfig(config, discoveryCacheDir(filepath.Join(cacheDir, "discovery"), config.Host), filepath.Join(cacheDir, "http"), discoveryCacheTTL)
 	if err != nil {
-		log.Debugf("Couldn't get the resource list for group version %s and resource %s: %s", exception.Group, resource, err.Error())
-		return false, nil
+		log.Debug("Couldn't create new discovery client with config")
+		return nil, err
 	}
 
-	for _, res := range resourceList.APIResources {
-		if res.Name == exception.Resource {
-			if (resource == res.Name) || contains(res.ShortNames, resource) || (resource == res.SingularName) {
-				log.Debug("resource ", resource, " matches a string in resource ", res.Name)
-				return true, nil
-			} else {
-				log.Debug("resource ", resource, " does not match any strings in resource ", res.Name)
-			}
-		}
-	}
+	return discoveryClient, nil
+}
 
-	return false, nil
+// discoveryCacheDir returns the directory kubectl caches discovery for the host in
+func discoveryCacheDir(parentDir string, host string) string {
+	schemelessHost := strings.Replace(strings.Replace(host, "https://", "", 1), "http://", "", 1)
+	return filepath.Join(parentDir, illegalCacheDirCharacters.ReplaceAllString(schemelessHost, "_"))
 }
 
 func checkIfUnlockExpired(unlockTimestamp string, kubeContext string, contextIndex int, config KubeLockConfig) (bool, error) {
@@ -414,3 +635,52 @@ func checkIfUnlockExpired(unlockTimestamp string, kubeContext string, contextInd
 	}
 	return true, nil
 }
+
+// findKubectlForArgs finds the kubectl binary to run for the context the command addresses
+func findKubectlForArgs(args []string) (string, error) {
+	config, err := getViperConfig()
+	if err != nil {
+		return "", err
+	}
+
+	kubeContext, _ := findContext(args)
+
+	return findKubectl(kubeContext, config)
+}
+
+// findKubectl finds the kubectl binary to run. In order of precedence it is set by the KUBE_LOCK_KUBECTL environment
+// variable, the context's 'kubectlPath', and the global 'kubectlPath'. Names without a path (e.g. 'oc' or
+// 'kubectl1.27') are looked up on the PATH.
+func findKubectl(kubeContext string, config KubeLockConfig) (string, error) {
+	name := os.Getenv(kubectlEnv)
+	if name == "" {
+		for _, c := range config.Contexts {
+			if c.Name == kubeContext {
+				name = c.KubectlPath
+			}
+		}
+	}
+	if name == "" {
+		name = config.KubectlPath
+	}
+	if name == "" {
+		return findRealKubectl()
+	}
+
+	if strings.ContainsRune(name, os.PathSeparator) {
+		if strings.HasPrefix(name, "~/") {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			name = filepath.Join(home, name[2:])
+		}
+
+		if _, err := os.Stat(name); err != nil {
+			return "", fmt.Errorf("kubectl '%s' not found: %w", name, err)
+		}
+		return name, nil
+	}
+
+	return findRealCommand(name)
+}
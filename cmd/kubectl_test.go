@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"testing"
+)
+
+const testContextFreeConfig = `
+contexts:
+  - name: prod
+    status: locked
+profiles: []
+`
+
+func TestEvaluateContextFreeVerbs(t *testing.T) {
+	setupTestConfig(t, newFakeAPIServer(t).Server, testContextFreeConfig, "prod")
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "config", args: []string{"config", "use-context", "dev"}},
+		{name: "config with the context", args: []string{"--context", "prod", "config", "view"}},
+		{name: "client version", args: []string{"version", "--client"}},
+		{name: "help", args: []string{"help", "get"}},
+		{name: "kustomize", args: []string{"kustomize", "overlays/prod"}},
+	}
+
+	// The context is locked, which would otherwise stop every command
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, ok, err := evaluateContext(nil, tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || len(args) != len(tt.args) {
+				t.Fatalf("got %v (ok %v), want the command to run as it is", args, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// systemConfigPath is the config for everyone on the machine, which is layered under the team and user configs
+	systemConfigPath = "/etc/kube-lock/config.yaml"
+	// policyDirEnv points at the team's config, which is layered between the system and user configs. It can be a
+	// file, or a directory (such as a git checkout) whose YAML files are layered in name order.
+	policyDirEnv = "KUBE_LOCK_POLICY_DIR"
+)
+
+// kubeLockConfigLayer is one of the config files layered into the config kube-lock uses
+type kubeLockConfigLayer struct {
+	Source string
+	Config KubeLockConfig
+}
+
+// findLowerConfigLayers reads the configs the user's config is layered onto, from the lowest: the system config (if
+// there is one) and then the team's. Once the system config pins trusted keys, there must be a team config signed
+// with one of them.
+func findLowerConfigLayers() ([]kubeLockConfigLayer, error) {
+	var layers []kubeLockConfigLayer
+	var system KubeLockConfig
+	if _, err := os.Stat(systemConfigPath); err == nil {
+		layer, err := readConfigLayer(systemConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+		system = layer.Config
+	}
+
+	policyDir := resolvePolicyDir(system)
+	if policyDir == "" && len(system.TrustedPolicyKeys) > 0 {
+		return nil, fmt.Errorf("refusing to run without a team config, as %s pins the keys it must be signed with (set its 'policyDir', or %s)", systemConfigPath, policyDirEnv)
+	} else if policyDir == "" {
+		return layers, nil
+	}
+
+	bundle, err := readPolicyBundle(policyDir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the team config '%s': %w", policyDir, err)
+	}
+
+	// Once keys are pinned, the team config is only used if it is signed with one of them
+	if len(system.TrustedPolicyKeys) > 0 {
+		_, err := verifyPolicyBundle(policyDir, bundle, system.TrustedPolicyKeys)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to use the team config '%s': %w", policyDir, err)
+		}
+	}
+
+	for _, file := range bundle {
+		layer, err := parseConfigLayer(file.Path, file.Data)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+
+	return layers, nil
+}
+
+// resolvePolicyDir returns where the team config is: the 'policyDir' the system config pins, or KUBE_LOCK_POLICY_DIR
+// if it doesn't pin one
+func resolvePolicyDir(system KubeLockConfig) string {
+	if system.PolicyDir != "" {
+		if env := os.Getenv(policyDirEnv); env != "" && env != system.PolicyDir {
+			log.Debug("The team config is pinned to '", system.PolicyDir, "' in '", systemConfigPath, "', so ", policyDirEnv, " '", env, "' is ignored.")
+		}
+		return system.PolicyDir
+	}
+
+	return os.Getenv(policyDirEnv)
+}
+
+// findPolicyDir returns where the team config is, reading the system config for the 'policyDir' it pins
+func findPolicyDir() (string, error) {
+	layer, err := readConfigLayer(systemConfigPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	return resolvePolicyDir(layer.Config), nil
+}
+
+// findPolicyFiles returns the team's config files, in the order they are layered
+func findPolicyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || (filepath.Ext(name) != ".yaml" && filepath.Ext(name) != ".yml") {
+			continue
+		}
+		files = append(files, filepath.Join(path, name))
+	}
+
+	return files, nil
+}
+
+// readConfigLayer reads a config file the same way as the user's config is read
+func readConfigLayer(path string) (kubeLockConfigLayer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return kubeLockConfigLayer{}, err
+	}
+
+	return parseConfigLayer(path, data)
+}
+
+func parseConfigLayer(source string, data []byte) (kubeLockConfigLayer, error) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(bytes.NewReader(data))
+	if err != nil {
+		return kubeLockConfigLayer{}, fmt.Errorf("unable to read '%s': %w", source, err)
+	}
+
+	config := KubeLockConfig{}
+	err = v.Unmarshal(&config)
+	if err != nil {
+		return kubeLockConfigLayer{}, fmt.Errorf("unable to read '%s': %w", source, err)
+	}
+
+	return kubeLockConfigLayer{Source: source, Config: config}, nil
+}
+
+// mergeConfigLayers layers the configs from the lowest. The settings of each layer replace those below it, and its
+// contexts, profiles and tools replace those of the same name, unless they are enforced by a layer below.
+// Everything in the merged config records which layer it came from.
+func mergeConfigLayers(layers []kubeLockConfigLayer) KubeLockConfig {
+	merged := KubeLockConfig{Sources: map[string]string{}}
+	for _, layer := range layers {
+		config := layer.Config
+		for key, value := range map[string]string{"defaultProfile": config.DefaultProfile, "kubectlPath": config.KubectlPath} {
+			if value != "" {
+				merged.Sources[key] = layer.Source
+			}
+		}
+		if config.DefaultProfile != "" {
+			merged.DefaultProfile = config.DefaultProfile
+		}
+		// Any layer can shorten how long an unlock lasts, but none can lengthen it
+		if config.UnlockTimeoutPeriod != "" && shorterTimeout(config.UnlockTimeoutPeriod, merged.UnlockTimeoutPeriod) {
+			merged.UnlockTimeoutPeriod = config.UnlockTimeoutPeriod
+			merged.Sources["unlockTimeoutPeriod"] = layer.Source
+		} else if config.UnlockTimeoutPeriod != "" {
+			log.Debug("The unlock timeout period '", config.UnlockTimeoutPeriod, "' in '", layer.Source, "' is no shorter than '", merged.UnlockTimeoutPeriod, "' in '", merged.Sources["unlockTimeoutPeriod"], "', so it is ignored.")
+		}
+		if config.KubectlPath != "" {
+			merged.KubectlPath = config.KubectlPath
+		}
+		// Only the system config can say where the team config is, like the keys it must be signed with
+		if layer.Source == systemConfigPath && config.PolicyDir != "" {
+			merged.PolicyDir = config.PolicyDir
+			merged.Sources["policyDir"] = layer.Source
+		} else if config.PolicyDir != "" {
+			log.Debug("The team config is only pinned in '", systemConfigPath, "', so 'policyDir' in '", layer.Source, "' is ignored.")
+		}
+		// Keys pinned anywhere but the system config would let whoever can edit the team config sign it themselves
+		if layer.Source == systemConfigPath && len(config.TrustedPolicyKeys) > 0 {
+			merged.TrustedPolicyKeys = config.TrustedPolicyKeys
+			merged.Sources["trustedPolicyKeys"] = layer.Source
+		} else if len(config.TrustedPolicyKeys) > 0 {
+			log.Debug("Trusted policy keys are only read from '", systemConfigPath, "', so those in '", layer.Source, "' are ignored.")
+		}
+
+		for _, context := range config.Contexts {
+			context.Source = layer.Source
+			i := findContextIndex(context.Name, merged)
+			switch {
+			case i == -1:
+				merged.Contexts = append(merged.Contexts, context)
+			case merged.Contexts[i].Enforced:
+				log.Debug("Context '", context.Name, "' is enforced by '", merged.Contexts[i].Source, "', so only its lock state is used from '", layer.Source, "'.")
+				merged.Contexts[i] = withLockState(merged.Contexts[i], context)
+			default:
+				merged.Contexts[i] = context
+			}
+		}
+
+		for _, profile := range config.Profiles {
+			profile.Source = layer.Source
+			i := findProfileIndex(profile.Name, merged)
+			switch {
+			case i == -1:
+				merged.Profiles = append(merged.Profiles, profile)
+			case merged.Profiles[i].Enforced:
+				log.Debug("Profile '", profile.Name, "' is enforced by '", merged.Profiles[i].Source, "', so it is ignored in '", layer.Source, "'.")
+			default:
+				merged.Profiles[i] = profile
+			}
+		}
+
+		for _, tool := range config.Tools {
+			tool.Source = layer.Source
+			if i := findToolIndex(tool.Name, merged); i == -1 {
+				merged.Tools = append(merged.Tools, tool)
+			} else {
+				merged.Tools[i] = tool
+			}
+		}
+	}
+
+	return merged
+}
+
+// userConfigLayer returns what the user's config must hold for it to layer onto the lower layers as the config.
+// Whatever is the same as in the lower layers is left out, and what is enforced, or only in the lower layers, can't be
+// changed or removed.
+func userConfigLayer(config KubeLockConfig, lower KubeLockConfig, userSource string) (KubeLockConfig, error) {
+	user := KubeLockConfig{}
+	if config.DefaultProfile != lower.DefaultProfile || config.Sources["defaultProfile"] == userSource {
+		user.DefaultProfile = config.DefaultProfile
+	}
+	if lower.UnlockTimeoutPeriod != "" && config.UnlockTimeoutPeriod != lower.UnlockTimeoutPeriod && (config.UnlockTimeoutPeriod == "" || !shorterTimeout(config.UnlockTimeoutPeriod, lower.UnlockTimeoutPeriod)) {
+		return KubeLockConfig{}, fmt.Errorf("the unlock timeout period is '%s' in '%s', so it can only be shortened", lower.UnlockTimeoutPeriod, lower.Sources["unlockTimeoutPeriod"])
+	} else if config.UnlockTimeoutPeriod != lower.UnlockTimeoutPeriod || config.Sources["unlockTimeoutPeriod"] == userSource {
+		user.UnlockTimeoutPeriod = config.UnlockTimeoutPeriod
+	}
+	if config.KubectlPath != lower.KubectlPath || config.Sources["kubectlPath"] == userSource {
+		user.KubectlPath = config.KubectlPath
+	}
+
+	for _, context := range config.Contexts {
+		if i := findContextIndex(context.Name, lower); i != -1 {
+			base, source := lower.Contexts[i], context.Source
+			context.Source = base.Source
+			if reflect.DeepEqual(context, base) && source != userSource {
+				continue
+			} else if base.Enforced && !reflect.DeepEqual(withLockState(base, context), context) {
+				return KubeLockConfig{}, fmt.Errorf("context '%s' is enforced by '%s', so it can't be changed (other than locking or unlocking it)", context.Name, base.Source)
+			} else if base.Enforced {
+				// Only the user's own lock state is kept, so the rest of the context is always the enforced one
+				context = KubeLockContexts{Name: context.Name, Status: context.Status, UnlockTimestamp: context.UnlockTimestamp}
+			}
+		}
+		user.Contexts = append(user.Contexts, context)
+	}
+	for _, context := range lower.Contexts {
+		if findContextIndex(context.Name, config) == -1 {
+			return KubeLockConfig{}, fmt.Errorf("context '%s' is in '%s', so it can only be removed there", context.Name, context.Source)
+		}
+	}
+
+	for _, profile := range config.Profiles {
+		if i := findProfileIndex(profile.Name, lower); i != -1 {
+			base, source := lower.Profiles[i], profile.Source
+			profile.Source = base.Source
+			if reflect.DeepEqual(profile, base) && source != userSource {
+				continue
+			} else if base.Enforced {
+				return KubeLockConfig{}, fmt.Errorf("profile '%s' is enforced by '%s', so it can't be changed", profile.Name, base.Source)
+			}
+		}
+		user.Profiles = append(user.Profiles, profile)
+	}
+	for _, profile := range lower.Profiles {
+		if findProfileIndex(profile.Name, config) == -1 {
+			return KubeLockConfig{}, fmt.Errorf("profile '%s' is in '%s', so it can only be removed there", profile.Name, profile.Source)
+		}
+	}
+
+	for _, tool := range config.Tools {
+		if i := findToolIndex(tool.Name, lower); i != -1 {
+			source := tool.Source
+			tool.Source = lower.Tools[i].Source
+			if reflect.DeepEqual(tool, lower.Tools[i]) && source != userSource {
+				continue
+			}
+		}
+		user.Tools = append(user.Tools, tool)
+	}
+
+	return user, nil
+}
+
+// withLockState returns the context with the lock state of the other, if it has one: whether it is locked or
+// unlocked, and when it was unlocked. Lock state is each user's own, so it isn't part of what an enforced context
+// enforces. An unlock is only taken with the time it was unlocked, as without one it would never time out.
+func withLockState(context KubeLockContexts, other KubeLockContexts) KubeLockContexts {
+	if other.Status == "unlocked" && !validUnlockTimestamp(other.UnlockTimestamp) {
+		log.Debug("Context '", other.Name, "' is unlocked in '", other.Source, "' without a valid unlock timestamp, so it is ignored.")
+	} else if other.Status == "locked" || other.Status == "unlocked" {
+		context.Status = other.Status
+		context.UnlockTimestamp = other.UnlockTimestamp
+	}
+
+	return context
+}
+
+// validUnlockTimestamp checks if an unlock timestamp is one kube-lock could have written: parsable, and not in the
+// future
+func validUnlockTimestamp(unlockTimestamp string) bool {
+	timestamp, err := time.Parse(timestampLayout, unlockTimestamp)
+	return err == nil && !timestamp.After(time.Now())
+}
+
+// shorterTimeout checks if an unlock timeout period is shorter than the current one (or there isn't a current one).
+// A period that can't be parsed is taken, and a current one that can't be parsed is kept, so the error isn't hidden.
+func shorterTimeout(period string, current string) bool {
+	if current == "" {
+		return true
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil {
+		return true
+	}
+	currentDuration, err := time.ParseDuration(current)
+	if err != nil {
+		return false
+	}
+
+	return duration < currentDuration
+}
+
+func findContextIndex(kubeContext string, config KubeLockConfig) int {
+	for i := range config.Contexts {
+		if config.Contexts[i].Name == kubeContext {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func findToolIndex(tool string, config KubeLockConfig) int {
+	for i := range config.Tools {
+		if config.Tools[i].Name == tool {
+			return i
+		}
+	}
+
+	return -1
+}
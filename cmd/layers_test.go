@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeConfigLayersLockState(t *testing.T) {
+	unlocked := time.Now().Add(-time.Minute).Format(timestampLayout)
+	future := time.Now().Add(time.Hour).Format(timestampLayout)
+
+	tests := []struct {
+		name      string
+		user      KubeLockContexts
+		status    string
+		timestamp string
+	}{
+		{name: "locked", user: KubeLockContexts{Name: "prod", Status: "locked"}, status: "locked"},
+		{name: "unlocked", user: KubeLockContexts{Name: "prod", Status: "unlocked", UnlockTimestamp: unlocked}, status: "unlocked", timestamp: unlocked},
+		{name: "unlocked without a timestamp", user: KubeLockContexts{Name: "prod", Status: "unlocked"}, status: "restricted"},
+		{name: "unlocked with a malformed timestamp", user: KubeLockContexts{Name: "prod", Status: "unlocked", UnlockTimestamp: "forever"}, status: "restricted"},
+		{name: "unlocked in the future", user: KubeLockContexts{Name: "prod", Status: "unlocked", UnlockTimestamp: future}, status: "restricted"},
+		{name: "a profile", user: KubeLockContexts{Name: "prod", Status: "permissive"}, status: "restricted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := mergeConfigLayers([]kubeLockConfigLayer{
+				{Source: "team", Config: KubeLockConfig{Contexts: []KubeLockContexts{{Name: "prod", Status: "restricted", Enforced: true}}}},
+				{Source: "user", Config: KubeLockConfig{Contexts: []KubeLockContexts{tt.user}}},
+			})
+
+			context := merged.Contexts[0]
+			if context.Status != tt.status || context.UnlockTimestamp != tt.timestamp {
+				t.Fatalf("got status %q unlocked at %q, want %q unlocked at %q", context.Status, context.UnlockTimestamp, tt.status, tt.timestamp)
+			}
+			if !context.Enforced || context.Source != "team" {
+				t.Fatalf("got context from %q (enforced %v), want it enforced from the team config", context.Source, context.Enforced)
+			}
+		})
+	}
+}
+
+func TestMergeConfigLayersUnlockTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		periods []string
+		period  string
+		source  string
+	}{
+		{name: "only the user's", periods: []string{"", "", "1h"}, period: "1h", source: "user"},
+		{name: "the user shortens it", periods: []string{"", "1h", "10m"}, period: "10m", source: "user"},
+		{name: "the user can't lengthen it", periods: []string{"", "10m", "1h"}, period: "10m", source: "team"},
+		{name: "the user can't disable it", periods: []string{"", "10m", ""}, period: "10m", source: "team"},
+		{name: "the team can't lengthen the system's", periods: []string{"5m", "1h", ""}, period: "5m", source: "system"},
+		{name: "a malformed period isn't hidden", periods: []string{"", "10m", "soon"}, period: "soon", source: "user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers []kubeLockConfigLayer
+			for i, source := range []string{"system", "team", "user"} {
+				layers = append(layers, kubeLockConfigLayer{Source: source, Config: KubeLockConfig{UnlockTimeoutPeriod: tt.periods[i]}})
+			}
+
+			merged := mergeConfigLayers(layers)
+			if merged.UnlockTimeoutPeriod != tt.period || merged.Sources["unlockTimeoutPeriod"] != tt.source {
+				t.Fatalf("got %q from %q, want %q from %q", merged.UnlockTimeoutPeriod, merged.Sources["unlockTimeoutPeriod"], tt.period, tt.source)
+			}
+		})
+	}
+}
+
+func TestUserConfigLayerUnlockTimeout(t *testing.T) {
+	lower := mergeConfigLayers([]kubeLockConfigLayer{{Source: "team", Config: KubeLockConfig{UnlockTimeoutPeriod: "10m"}}})
+
+	tests := []struct {
+		name   string
+		period string
+		ok     bool
+	}{
+		{name: "unchanged", period: "10m", ok: true},
+		{name: "shortened", period: "5m", ok: true},
+		{name: "lengthened", period: "1h"},
+		{name: "disabled", period: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := lower
+			config.UnlockTimeoutPeriod = tt.period
+
+			_, err := userConfigLayer(config, lower, "user")
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMergeConfigLayers(t *testing.T) {
+	system := KubeLockConfig{
+		PolicyDir:         "/etc/kube-lock/policy",
+		TrustedPolicyKeys: []string{"system-key"},
+	}
+	team := KubeLockConfig{
+		DefaultProfile:    "restricted",
+		KubectlPath:       "/usr/bin/kubectl",
+		PolicyDir:         "/tmp/policy",
+		TrustedPolicyKeys: []string{"team-key"},
+		Contexts: []KubeLockContexts{
+			{Name: "prod", Status: "restricted", Enforced: true},
+			{Name: "staging", Status: "restricted"},
+		},
+		Profiles: []KubeLockProfiles{
+			{Name: "restricted", BlockedVerbs: []string{"delete"}, Enforced: true},
+			{Name: "permissive", BlockedVerbs: []string{"drain"}},
+		},
+	}
+	user := KubeLockConfig{
+		DefaultProfile:    "permissive",
+		PolicyDir:         "/home/user/policy",
+		TrustedPolicyKeys: []string{"user-key"},
+		Contexts: []KubeLockContexts{
+			{Name: "prod", Status: "permissive"},
+			{Name: "staging", Status: "permissive"},
+			{Name: "dev", Status: "unlocked"},
+		},
+		Profiles: []KubeLockProfiles{
+			{Name: "restricted", BlockedVerbs: []string{}},
+			{Name: "permissive", BlockedVerbs: []string{}},
+		},
+	}
+
+	merged := mergeConfigLayers([]kubeLockConfigLayer{
+		{Source: systemConfigPath, Config: system},
+		{Source: "team", Config: team},
+		{Source: "user", Config: user},
+	})
+
+	if merged.DefaultProfile != "permissive" || merged.Sources["defaultProfile"] != "user" {
+		t.Errorf("got default profile %q from %q, want the user's", merged.DefaultProfile, merged.Sources["defaultProfile"])
+	}
+	if merged.KubectlPath != "/usr/bin/kubectl" || merged.Sources["kubectlPath"] != "team" {
+		t.Errorf("got kubectl path %q from %q, want the team's", merged.KubectlPath, merged.Sources["kubectlPath"])
+	}
+	if merged.PolicyDir != system.PolicyDir || merged.Sources["policyDir"] != systemConfigPath {
+		t.Errorf("got policy dir %q from %q, want the system's", merged.PolicyDir, merged.Sources["policyDir"])
+	}
+	if len(merged.TrustedPolicyKeys) != 1 || merged.TrustedPolicyKeys[0] != "system-key" || merged.Sources["trustedPolicyKeys"] != systemConfigPath {
+		t.Errorf("got trusted keys %v from %q, want the system's", merged.TrustedPolicyKeys, merged.Sources["trustedPolicyKeys"])
+	}
+
+	contexts := []struct {
+		name   string
+		status string
+		source string
+	}{
+		{name: "prod", status: "restricted", source: "team"},
+		{name: "staging", status: "permissive", source: "user"},
+		{name: "dev", status: "unlocked", source: "user"},
+	}
+	for _, want := range contexts {
+		i := findContextIndex(want.name, merged)
+		if i == -1 {
+			t.Errorf("context %q is missing", want.name)
+		} else if context := merged.Contexts[i]; context.Status != want.status || context.Source != want.source {
+			t.Errorf("got context %q with status %q from %q, want %q from %q", want.name, context.Status, context.Source, want.status, want.source)
+		}
+	}
+
+	profiles := []struct {
+		name    string
+		blocked int
+		source  string
+	}{
+		{name: "restricted", blocked: 1, source: "team"},
+		{name: "permissive", blocked: 0, source: "user"},
+	}
+	for _, want := range profiles {
+		i := findProfileIndex(want.name, merged)
+		if i == -1 {
+			t.Errorf("profile %q is missing", want.name)
+		} else if profile := merged.Profiles[i]; len(profile.BlockedVerbs) != want.blocked || profile.Source != want.source {
+			t.Errorf("got profile %q blocking %v from %q, want %d verbs from %q", want.name, profile.BlockedVerbs, profile.Source, want.blocked, want.source)
+		}
+	}
+}
+
+func TestUserConfigLayer(t *testing.T) {
+	lower := mergeConfigLayers([]kubeLockConfigLayer{{Source: "team", Config: KubeLockConfig{
+		Contexts: []KubeLockContexts{
+			{Name: "prod", Status: "restricted", Enforced: true},
+			{Name: "staging", Status: "restricted"},
+		},
+		Profiles: []KubeLockProfiles{
+			{Name: "restricted", BlockedVerbs: []string{"delete"}, Enforced: true},
+			{Name: "permissive", BlockedVerbs: []string{"drain"}},
+		},
+	}}})
+	unlocked := time.Now().Add(-time.Minute).Format(timestampLayout)
+
+	tests := []struct {
+		name   string
+		change func(config *KubeLockConfig)
+		err    string
+	}{
+		{name: "unchanged", change: func(config *KubeLockConfig) {}},
+		{name: "an enforced context unlocked", change: func(config *KubeLockConfig) {
+			config.Contexts[0].Status, config.Contexts[0].UnlockTimestamp = "unlocked", unlocked
+		}},
+		{name: "an enforced context changed", change: func(config *KubeLockConfig) {
+			config.Contexts[0].Status = "permissive"
+		}, err: "context 'prod' is enforced by 'team'"},
+		{name: "a context changed", change: func(config *KubeLockConfig) {
+			config.Contexts[1].Status = "permissive"
+		}},
+		{name: "a context removed", change: func(config *KubeLockConfig) {
+			config.Contexts = config.Contexts[:1]
+		}, err: "context 'staging' is in 'team', so it can only be removed there"},
+		{name: "a context added", change: func(config *KubeLockConfig) {
+			config.Contexts = append(config.Contexts, KubeLockContexts{Name: "dev", Status: "unlocked"})
+		}},
+		{name: "an enforced profile changed", change: func(config *KubeLockConfig) {
+			config.Profiles[0].BlockedVerbs = nil
+		}, err: "profile 'restricted' is enforced by 'team'"},
+		{name: "a profile changed", change: func(config *KubeLockConfig) {
+			config.Profiles[1].BlockedVerbs = nil
+		}},
+		{name: "a profile removed", change: func(config *KubeLockConfig) {
+			config.Profiles = config.Profiles[:1]
+		}, err: "profile 'permissive' is in 'team', so it can only be removed there"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := lower
+			config.Contexts = append([]KubeLockContexts{}, lower.Contexts...)
+			config.Profiles = append([]KubeLockProfiles{}, lower.Profiles...)
+			tt.change(&config)
+
+			_, err := userConfigLayer(config, lower, "user")
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
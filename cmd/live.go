@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	gocontext "context"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// readOnlyTransport refuses every request that could change something, so kube-lock's own checks against the cluster
+// can never write to it, whatever the context is allowed to do
+type readOnlyTransport struct {
+	next http.RoundTripper
+}
+
+func (t readOnlyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, fmt.Errorf("kube-lock only reads from the cluster, so refused to %s '%s'", r.Method, r.URL.Path)
+	}
+
+	return t.next.RoundTrip(r)
+}
+
+// newReadOnlyClient returns a client for the context that can only read, and the namespace the context uses by default
+func newReadOnlyClient(kubeContext string, kubeconfig string) (dynamic.Interface, string, error) {
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		kubeconfigLoadingRules(kubeconfig),
+		&clientcmd.ConfigOverrides{CurrentContext: kubeContext},
+	)
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return readOnlyTransport{next: rt}
+	})
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return client, namespace, nil
+}
+
+// liveResourceClient returns a read-only client for the resource in the request's namespace (unless it is cluster
+// scoped, or the request is for all namespaces)
+func liveResourceClient(req kubeLockRequest, resource kubeLockResource) (dynamic.ResourceInterface, error) {
+	client, namespace, err := newReadOnlyClient(req.Context, req.Flags["kubeconfig"])
+	if err != nil {
+		return nil, err
+	}
+
+	gvr := schema.GroupVersionResource{Group: resource.Group, Version: resource.Versions[0], Resource: resource.Name}
+	if resource.ClusterScoped || flagSet(req.Flags, "--all-namespaces") {
+		return client.Resource(gvr), nil
+	}
+
+	if req.Namespace != "" {
+		namespace = req.Namespace
+	}
+	return client.Resource(gvr).Namespace(namespace), nil
+}
+
+// verifyObjectLabels fetches the live objects, and checks the selector selects every one of them
+func verifyObjectLabels(req kubeLockRequest, resource kubeLockResource, names []string, selector labels.Selector) (bool, error) {
+	client, err := liveResourceClient(req, resource)
+	if err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		object, err := client.Get(gocontext.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			log.Warn("Unable to check the labels of ", resource, " '", name, "': ", err)
+			return false, nil
+		}
+
+		if !selector.Matches(labels.Set(object.GetLabels())) {
+			log.Debug(resource, " '", name, "' is not selected by '", selector, "'")
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -7,8 +7,14 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	// Used for flags.
+	lockReadOnly bool
+)
+
 func init() {
 	rootCmd.AddCommand(lockCmd)
+	lockCmd.Flags().BoolVar(&lockReadOnly, "read-only", false, "switch to a kubeconfig that can only read from the context, through the kube-lock proxy (use with 'eval \"$(kubectl-lock lock --read-only)\"')")
 }
 
 var lockCmd = &cobra.Command{
@@ -50,12 +56,16 @@ func setLock(cmd *cobra.Command, args []string) error {
 	log.Info("Locking Context '", kubeContext, "'.")
 	setContextStatus(kubeContext, index, "locked", config)
 
+	if lockReadOnly {
+		return switchToReadOnlyKubeconfig(kubeContext)
+	}
+
 	return nil
 }
 
 func setContextStatus(kubeContext string, index int, status string, config KubeLockConfig) {
-	if status == ("unlocked") && config.Contexts[index].Status == "locked" {
-		log.Debug("Setting context from 'locked' to 'unlocked', marking unlock Timestamp to check for timeout later...")
+	if status == "unlocked" {
+		log.Debug("Setting context to 'unlocked', marking unlock Timestamp to check for timeout later...")
 		config.Contexts[index].UnlockTimestamp = time.Now().Format(timestampLayout)
 	} else if config.Contexts[index].UnlockTimestamp != "" {
 		log.Debug("Clearing unlock timestamp...")
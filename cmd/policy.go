@@ -0,0 +1,360 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// policySignatureFile is the signature of a team config directory, which covers every config file in it
+	policySignatureFile = "kube-lock.sig"
+	// defaultPolicyValidity is how long a team config's signature is valid for, unless it is signed with '--valid-for'
+	defaultPolicyValidity = 30 * 24 * time.Hour
+)
+
+var (
+	// Used for flags.
+	policyKeyFile    string
+	policyPublicKeys []string
+	policyValidFor   time.Duration
+)
+
+// policyFile is one of the team's config files. It is only read once, so what is verified is what is used.
+type policyFile struct {
+	Path string
+	Data []byte
+}
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.AddCommand(policyKeygenCmd)
+	policyCmd.AddCommand(policySignCmd)
+	policyCmd.AddCommand(policyVerifyCmd)
+	policyKeygenCmd.Flags().StringVar(&policyKeyFile, "key", "", "the file to write the private key to")
+	policySignCmd.Flags().StringVar(&policyKeyFile, "key", "", "the private key to sign with, from 'policy keygen'")
+	policySignCmd.Flags().DurationVar(&policyValidFor, "valid-for", defaultPolicyValidity, "how long the signature is valid for, after which the config must be signed again")
+	policyVerifyCmd.Flags().StringSliceVar(&policyPublicKeys, "public-key", nil, "check against these public keys instead of those pinned in "+systemConfigPath)
+	policyKeygenCmd.MarkFlagRequired("key")
+	policySignCmd.MarkFlagRequired("key")
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Sign and verify team configs.",
+	Long: "A team config (from " + policyDirEnv + ") can be signed, so it can't be edited to weaken it. " +
+		"Once ed25519 public keys are pinned in the system config, e.g.\n\n" +
+		"  # " + systemConfigPath + "\n  trustedPolicyKeys:\n    - <public key from 'policy keygen'>\n\n" +
+		"kube-lock refuses to run with a team config that isn't signed by one of them, or has changed since it was signed, and refuses to run without one at all. " +
+		"The system config can pin where the team config is too, with 'policyDir', which is used in place of " + policyDirEnv + ". " +
+		"The signature of a directory is in its '" + policySignatureFile + "' file, and covers every config file in it, so adding or removing one breaks it too. " +
+		"The signature of a single file is in the file with '.sig' added to its name.\n\n" +
+		"A signature is only valid until it expires (after '--valid-for'), so a config that has since been replaced (e.g. by checking out an older commit) can't be used in place of the current one once its signature has expired. " +
+		"Until then it can be, as kube-lock keeps no record of which configs it has seen, so keep '--valid-for' as short as re-signing allows.",
+}
+
+var policyKeygenCmd = &cobra.Command{
+	Use:    "keygen --key <file>",
+	Short:  "Generate a key to sign team configs with, and print its public key.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		publicKey, err := generatePolicyKey(policyKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("Wrote the private key to '", policyKeyFile, "'. Pin the public key in ", systemConfigPath, " under 'trustedPolicyKeys':")
+		fmt.Println(publicKey)
+	},
+}
+
+var policySignCmd = &cobra.Command{
+	Use:    "sign [path] --key <file>",
+	Short:  "Sign a team config (" + policyDirEnv + " by default).",
+	Args:   cobra.MaximumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		path, err := policyPath(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if policyValidFor <= 0 {
+			log.Fatal("'--valid-for' must be longer than 0")
+		}
+
+		expires := time.Now().Add(policyValidFor).UTC().Truncate(time.Second)
+		signaturePath, publicKey, err := signPolicyBundle(path, policyKeyFile, expires)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("Signed '", path, "' with key '", publicKey, "' until ", expires.Format(time.RFC3339), ", in '", signaturePath, "'.")
+	},
+}
+
+var policyVerifyCmd = &cobra.Command{
+	Use:    "verify [path]",
+	Short:  "Check the signature of a team config (" + policyDirEnv + " by default).",
+	Args:   cobra.MaximumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		path, err := policyPath(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		publicKey, err := verifyPolicy(path, policyPublicKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("'", path, "' is signed by trusted key '", publicKey, "'.")
+	},
+}
+
+// runningPolicyCommand checks if the command being run is one of the policy commands
+func runningPolicyCommand() bool {
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	return err == nil && cmd.HasParent() && cmd.Parent() == policyCmd
+}
+
+// policyPath returns the team config the command is for
+func policyPath(args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+
+	path, err := findPolicyDir()
+	if err != nil {
+		return "", err
+	} else if path == "" {
+		return "", fmt.Errorf("no team config given, and neither %s nor 'policyDir' in %s is set", policyDirEnv, systemConfigPath)
+	}
+
+	return path, nil
+}
+
+// readPolicyBundle reads the team's config files, in the order they are layered
+func readPolicyBundle(path string) ([]policyFile, error) {
+	files, err := findPolicyFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle []policyFile
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		bundle = append(bundle, policyFile{Path: file, Data: data})
+	}
+
+	return bundle, nil
+}
+
+// policySignaturePath returns where the signature of the team config is kept
+func policySignaturePath(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	} else if info.IsDir() {
+		return filepath.Join(path, policySignatureFile), nil
+	}
+
+	return path + ".sig", nil
+}
+
+// policySignature is the signature of a team config, and when it expires
+type policySignature struct {
+	Expires   time.Time
+	Signature []byte
+}
+
+// policyBundleDigest is what is signed: when the signature expires, then the hash and name of every file like
+// 'sha256sum' lists them
+func policyBundleDigest(bundle []policyFile, expires time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "expires: %s\n", expires.UTC().Format(time.RFC3339))
+	for _, file := range bundle {
+		fmt.Fprintf(&b, "%x  %s\n", sha256.Sum256(file.Data), filepath.Base(file.Path))
+	}
+
+	return b.Bytes()
+}
+
+// signPolicyBundle signs the team config with the private key until it expires, and returns where the signature was
+// written and the public key to verify it with
+func signPolicyBundle(path string, keyFile string, expires time.Time) (string, string, error) {
+	key, err := readPolicyKey(keyFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	bundle, err := readPolicyBundle(path)
+	if err != nil {
+		return "", "", err
+	} else if len(bundle) == 0 {
+		return "", "", fmt.Errorf("'%s' has no config files to sign", path)
+	}
+
+	signaturePath, err := policySignaturePath(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	signature := ed25519.Sign(key, policyBundleDigest(bundle, expires))
+	err = os.WriteFile(signaturePath, []byte(formatPolicySignature(policySignature{Expires: expires, Signature: signature})), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	return signaturePath, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// verifyPolicy checks the signature of the team config against the public keys, or those pinned in the system config
+func verifyPolicy(path string, publicKeys []string) (string, error) {
+	if len(publicKeys) == 0 {
+		layer, err := readConfigLayer(systemConfigPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		publicKeys = layer.Config.TrustedPolicyKeys
+	}
+	if len(publicKeys) == 0 {
+		return "", fmt.Errorf("no trusted policy keys are pinned in %s, so there is nothing to verify against (use '--public-key')", systemConfigPath)
+	}
+
+	bundle, err := readPolicyBundle(path)
+	if err != nil {
+		return "", err
+	}
+
+	return verifyPolicyBundle(path, bundle, publicKeys)
+}
+
+// verifyPolicyBundle checks the team config was signed by one of the trusted keys, and that the signature hasn't
+// expired, and returns the key that signed it
+func verifyPolicyBundle(path string, bundle []policyFile, trustedKeys []string) (string, error) {
+	signaturePath, err := policySignaturePath(path)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(signaturePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("'%s' isn't signed (no '%s'), and trusted policy keys are pinned in %s", path, signaturePath, systemConfigPath)
+	} else if err != nil {
+		return "", err
+	}
+
+	signature, ok := parsePolicySignature(data)
+	if !ok {
+		return "", fmt.Errorf("'%s' isn't a valid signature (sign the config again with 'policy sign')", signaturePath)
+	}
+
+	digest := policyBundleDigest(bundle, signature.Expires)
+	for _, trustedKey := range trustedKeys {
+		publicKey, err := parsePolicyPublicKey(trustedKey)
+		if err != nil {
+			return "", err
+		}
+
+		if !ed25519.Verify(publicKey, digest, signature.Signature) {
+			continue
+		} else if time.Now().After(signature.Expires) {
+			return "", fmt.Errorf("'%s' expired at %s, so the config must be signed again", signaturePath, signature.Expires.Format(time.RFC3339))
+		}
+
+		return trustedKey, nil
+	}
+
+	return "", fmt.Errorf("'%s' isn't the signature of a trusted key, or the config has changed since it was signed", signaturePath)
+}
+
+// formatPolicySignature returns the contents of a signature file
+func formatPolicySignature(signature policySignature) string {
+	return "expires: " + signature.Expires.UTC().Format(time.RFC3339) + "\n" + "signature: " + base64.StdEncoding.EncodeToString(signature.Signature) + "\n"
+}
+
+// parsePolicySignature parses a signature file written by formatPolicySignature
+func parsePolicySignature(data []byte) (policySignature, bool) {
+	fields := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		key, value, _ := strings.Cut(line, ":")
+		fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	expires, err := time.Parse(time.RFC3339, fields["expires"])
+	if err != nil {
+		return policySignature{}, false
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields["signature"])
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return policySignature{}, false
+	}
+
+	return policySignature{Expires: expires, Signature: signature}, true
+}
+
+// generatePolicyKey writes a new private key to the file, and returns its public key
+func generatePolicyKey(keyFile string) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	// O_EXCL so an existing key (which configs may already be signed with) is never overwritten
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(privateKey) + "\n")
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+// readPolicyKey reads a private key written by 'policy keygen'
+func readPolicyKey(keyFile string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("'%s' isn't an ed25519 private key from 'policy keygen'", keyFile)
+	}
+
+	return ed25519.PrivateKey(key), nil
+}
+
+func parsePolicyPublicKey(key string) (ed25519.PublicKey, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("trusted policy key '%s' isn't a base64 ed25519 public key", key)
+	}
+
+	return ed25519.PublicKey(publicKey), nil
+}
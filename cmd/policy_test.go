@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestPolicy writes a team config directory with the files
+func writeTestPolicy(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// signTestPolicy signs the team config directory until it expires
+func signTestPolicy(t *testing.T, dir string, keyFile string, expires time.Time) {
+	t.Helper()
+
+	if _, _, err := signPolicyBundle(dir, keyFile, expires); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPolicySignature(t *testing.T) {
+	keyDir := t.TempDir()
+	keyFile, otherKeyFile := filepath.Join(keyDir, "key"), filepath.Join(keyDir, "other")
+	publicKey, err := generatePolicyKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generatePolicyKey(otherKeyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := map[string]string{"10-contexts.yaml": "contexts: []\n", "20-profiles.yaml": "profiles: []\n"}
+	v2 := map[string]string{"10-contexts.yaml": "contexts: []\n", "20-profiles.yaml": "profiles:\n  - name: strict\n"}
+	valid := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name string
+		// setup writes and signs the team config in the directory
+		setup func(t *testing.T, dir string)
+		err   string
+	}{
+		{
+			name: "signed",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, valid)
+			},
+		},
+		{
+			name: "unsigned",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+			},
+			err: "isn't signed",
+		},
+		{
+			name: "signed with a key that isn't trusted",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, otherKeyFile, valid)
+			},
+			err: "isn't the signature of a trusted key",
+		},
+		{
+			name: "file changed since it was signed",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, valid)
+				writeTestPolicy(t, dir, map[string]string{"20-profiles.yaml": "profiles:\n  - name: lax\n"})
+			},
+			err: "has changed since it was signed",
+		},
+		{
+			name: "file added since it was signed",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, valid)
+				writeTestPolicy(t, dir, map[string]string{"30-more.yaml": "profiles: []\n"})
+			},
+			err: "has changed since it was signed",
+		},
+		{
+			name: "expiry extended since it was signed",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, time.Now().Add(-time.Hour))
+				path := filepath.Join(dir, policySignatureFile)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				signature, _ := parsePolicySignature(data)
+				signature.Expires = valid
+				if err := os.WriteFile(path, []byte(formatPolicySignature(signature)), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "has changed since it was signed",
+		},
+		{
+			name: "signature without an expiry",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, valid)
+				path := filepath.Join(dir, policySignatureFile)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				signature, _ := parsePolicySignature(data)
+				if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(signature.Signature)+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "isn't a valid signature",
+		},
+		{
+			// The older config and its signature are put back (e.g. by checking out an older commit), after the
+			// current one replaced it
+			name: "rolled back to an expired config",
+			setup: func(t *testing.T, dir string) {
+				writeTestPolicy(t, dir, v1)
+				signTestPolicy(t, dir, keyFile, time.Now().Add(-time.Minute))
+				old, err := os.ReadFile(filepath.Join(dir, policySignatureFile))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				writeTestPolicy(t, dir, v2)
+				signTestPolicy(t, dir, keyFile, valid)
+
+				writeTestPolicy(t, dir, v1)
+				writeTestPolicy(t, dir, map[string]string{policySignatureFile: string(old)})
+			},
+			err: "expired at",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.setup(t, dir)
+
+			bundle, err := readPolicyBundle(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key, err := verifyPolicyBundle(dir, bundle, []string{publicKey})
+			if tt.err == "" && (err != nil || key != publicKey) {
+				t.Fatalf("got key %q and error %v, want it verified by %q", key, err, publicKey)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
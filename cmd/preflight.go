@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	gocontext "context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// preflightListLimit is how many of the affected objects are listed before the rest are only counted
+const preflightListLimit = 10
+
+// KubeLockPreflightRules count the live objects a destructive command would affect, and block it (or ask for
+// confirmation) if there are more than the threshold. The group and resource are patterns like those of delete
+// exceptions, so "" is the core group and '*' is any group. The resource defaults to every resource, and the verbs to
+// all of 'delete', 'drain' and 'scale'.
+type KubeLockPreflightRules struct {
+	Verbs     []string `yaml:"verbs,omitempty"`
+	Group     string   `yaml:"group"`
+	Resource  string   `yaml:"resource,omitempty"`
+	Threshold int      `yaml:"threshold"`
+	Action    string   `yaml:"action,omitempty"`
+}
+
+// getPreflightVerbs returns the verbs a pre-flight can be run for
+func getPreflightVerbs() []string {
+	return []string{"delete", "drain", "scale"}
+}
+
+// validatePreflightRules checks that the pre-flight rules in the config are usable, so mistakes are reported when the config is loaded
+func validatePreflightRules(config KubeLockConfig) error {
+	for _, profile := range config.Profiles {
+		for i, rule := range profile.PreflightRules {
+			for _, verb := range rule.Verbs {
+				if !contains(getPreflightVerbs(), verb) {
+					return fmt.Errorf("pre-flight rule #%d in profile '%s' has verb '%s', which pre-flights aren't run for (must be one of '%s')", i+1, profile.Name, verb, strings.Join(getPreflightVerbs(), "','"))
+				}
+			}
+
+			if rule.Threshold < 0 {
+				return fmt.Errorf("pre-flight rule #%d in profile '%s' has a negative threshold", i+1, profile.Name)
+			}
+
+			action := ruleAction(rule.Action)
+			if action != ruleActionBlock && action != ruleActionConfirm {
+				return fmt.Errorf("pre-flight rule #%d in profile '%s' has unknown action '%s' (must be '%s' or '%s')", i+1, profile.Name, rule.Action, ruleActionBlock, ruleActionConfirm)
+			}
+
+			if _, err := (kubeLockResource{}).matchesRule(rule.resourceRule()); err != nil {
+				return fmt.Errorf("pre-flight rule #%d in profile '%s': %w", i+1, profile.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resourceRule returns the group/resource the rule applies to, in the form resources are matched against
+func (rule KubeLockPreflightRules) resourceRule() KubeLockDeleteExceptions {
+	resource := rule.Resource
+	if resource == "" {
+		resource = "*"
+	}
+
+	return KubeLockDeleteExceptions{Group: rule.Group, Resource: resource}
+}
+
+// evaluatePreflight lists the live objects the command would affect, through a read-only client, and checks how many
+// there are against the profile's pre-flight rules. It returns nil if no rule decides anything. Commands whose targets
+// can't be resolved (or that have none) are denied, as what they would affect can't be counted.
+func evaluatePreflight(profile KubeLockProfiles, req kubeLockRequest) (*kubeLockDecision, error) {
+	var rules []KubeLockPreflightRules
+	for _, rule := range profile.PreflightRules {
+		if contains(getPreflightVerbs(), req.Verb) && (len(rule.Verbs) == 0 || contains(rule.Verbs, req.Verb)) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	targets := requestTargets(req)
+	// Draining a node evicts its pods, while an eviction through the proxy is of the pod it names
+	if req.Verb == "drain" && !isEviction(req) {
+		targets = []kubeLockTarget{{Resource: "pods"}}
+	}
+	if len(targets) == 0 {
+		d := deny("Pre-flight: unable to tell what '%s' would affect, as the command doesn't say which resources it is for!", req.Verb)
+		return &d, nil
+	}
+
+	pods, _, err := resolveResource("pods")
+	if err != nil {
+		return nil, err
+	}
+
+	var decision *kubeLockDecision
+	for _, target := range targets {
+		if target.Unread != "" {
+			d := deny("Pre-flight: unable to read '%s', so what '%s' would affect can't be counted!", target.Unread, req.Verb)
+			return &d, nil
+		}
+
+		resource, ok, err := resolveResource(target.Resource)
+		if err != nil || !ok {
+			d := deny("Pre-flight: unable to resolve resource '%s', so what '%s' would affect can't be counted!", target.Resource, req.Verb)
+			return &d, nil
+		}
+
+		// Draining and scaling down remove pods, so they are what is counted
+		counted := resource
+		if req.Verb == "drain" || req.Verb == "scale" {
+			counted = pods
+		}
+
+		var matched []KubeLockPreflightRules
+		for _, rule := range rules {
+			if ok, _ := counted.matchesRule(rule.resourceRule()); ok {
+				matched = append(matched, rule)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		count, description, err := countAffectedObjects(req, target, resource)
+		if err != nil {
+			d := deny("Unable to run the pre-flight check for '%s': %s", resource, err)
+			return &d, nil
+		}
+		log.Info("Pre-flight: '", req.Verb, "' would affect ", description, ".")
+
+		for _, rule := range matched {
+			if count <= rule.Threshold {
+				continue
+			}
+
+			reason := fmt.Sprintf("Pre-flight: '%s' would affect %d %s, which is more than the %d Profile '%s' allows at once!", req.Verb, count, counted, rule.Threshold, profile.Name)
+			if ruleAction(rule.Action) == ruleActionBlock {
+				d := deny("%s", reason)
+				return &d, nil
+			} else if decision == nil {
+				d := confirm("%s", reason)
+				decision = &d
+			}
+		}
+	}
+
+	return decision, nil
+}
+
+// countAffectedObjects returns how many objects the command would affect, and describes them for messages. Scaling
+// counts the pods that scaling down would remove, rather than the workloads scaled.
+func countAffectedObjects(req kubeLockRequest, target kubeLockTarget, resource kubeLockResource) (int, string, error) {
+	if req.Verb == "scale" {
+		return findScaledDownPods(req, target, resource)
+	}
+
+	objects, err := findAffectedObjects(req, target, resource)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return len(objects), describeObjects(resource, objects), nil
+}
+
+// findAffectedObjects returns the names of the objects of the target the command would affect. Objects the command
+// names are used as they are, and those it selects ('--all', '-l' or '--field-selector') are listed from the cluster.
+func findAffectedObjects(req kubeLockRequest, target kubeLockTarget, resource kubeLockResource) ([]string, error) {
+	if req.Verb == "drain" && !isEviction(req) {
+		return findDrainedPods(req)
+	}
+
+	if len(target.Names) > 0 {
+		return target.Names, nil
+	}
+
+	if !flagSet(req.Flags, "--all") && req.Flags["selector"] == "" && req.Flags["field-selector"] == "" {
+		return nil, nil
+	}
+
+	client, err := liveResourceClient(req, resource)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := client.List(gocontext.Background(), metav1.ListOptions{LabelSelector: req.Flags["selector"], FieldSelector: req.Flags["field-selector"]})
+	if err != nil {
+		return nil, err
+	}
+
+	return objectNames(list.Items), nil
+}
+
+// isEviction checks if a 'drain' is the eviction of the pods it names (as a request through the proxy is), rather than
+// the draining of nodes
+func isEviction(req kubeLockRequest) bool {
+	return req.Verb == "drain" && len(req.Resources) > 0
+}
+
+// findScaledDownPods returns how many pods scaling the workloads of the target to '--replicas' would remove, from the
+// replicas they have now, and describes the workloads scaled down
+func findScaledDownPods(req kubeLockRequest, target kubeLockTarget, resource kubeLockResource) (int, string, error) {
+	replicas, err := strconv.Atoi(req.Flags["replicas"])
+	if err != nil {
+		return 0, "", fmt.Errorf("'--replicas' must be a number, not '%s'", req.Flags["replicas"])
+	}
+
+	client, err := liveResourceClient(req, resource)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var workloads []unstructured.Unstructured
+	if len(target.Names) > 0 {
+		for _, name := range target.Names {
+			workload, err := client.Get(gocontext.Background(), name, metav1.GetOptions{})
+			if err != nil {
+				return 0, "", err
+			}
+			workloads = append(workloads, *workload)
+		}
+	} else if flagSet(req.Flags, "--all") || req.Flags["selector"] != "" {
+		list, err := client.List(gocontext.Background(), metav1.ListOptions{LabelSelector: req.Flags["selector"]})
+		if err != nil {
+			return 0, "", err
+		}
+		workloads = list.Items
+	}
+
+	var removed int
+	var scaled []string
+	for _, workload := range workloads {
+		// Workloads without replicas set run one
+		current, found, err := unstructured.NestedInt64(workload.Object, "spec", "replicas")
+		if err != nil {
+			return 0, "", err
+		} else if !found {
+			current = 1
+		}
+
+		if int(current) > replicas {
+			removed += int(current) - replicas
+			scaled = append(scaled, fmt.Sprintf("'%s' from %d to %d", workload.GetName(), current, replicas))
+		}
+	}
+
+	description := fmt.Sprintf("%d pods", removed)
+	if len(scaled) > 0 {
+		description += " (scaling " + strings.Join(scaled, ", ") + ")"
+	}
+
+	return removed, description, nil
+}
+
+// findDrainedPods returns the pods draining the nodes would evict. DaemonSet and mirror pods aren't evicted.
+func findDrainedPods(req kubeLockRequest) ([]string, error) {
+	nodes, err := liveResourceClient(req, kubeLockResource{Name: "nodes", Versions: []string{"v1"}, ClusterScoped: true})
+	if err != nil {
+		return nil, err
+	}
+
+	nodeNames := req.Names
+	if selector := req.Flags["selector"]; selector != "" {
+		list, err := nodes.List(gocontext.Background(), metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		nodeNames = objectNames(list.Items)
+	}
+
+	podsRequest := req
+	podsRequest.Flags = map[string]string{"all-namespaces": "true"}
+	pods, err := liveResourceClient(podsRequest, kubeLockResource{Name: "pods", Versions: []string{"v1"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, node := range nodeNames {
+		list, err := pods.List(gocontext.Background(), metav1.ListOptions{LabelSelector: req.Flags["pod-selector"], FieldSelector: "spec.nodeName=" + node})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pod := range list.Items {
+			if _, mirror := pod.GetAnnotations()["kubernetes.io/config.mirror"]; mirror || ownedByDaemonSet(pod) {
+				continue
+			}
+			names = append(names, pod.GetNamespace()+"/"+pod.GetName())
+		}
+	}
+
+	return names, nil
+}
+
+func ownedByDaemonSet(object unstructured.Unstructured) bool {
+	for _, owner := range object.GetOwnerReferences() {
+		if owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// objectNames returns the names of the objects, qualified with their namespace if they are from more than one
+func objectNames(objects []unstructured.Unstructured) []string {
+	namespaces := map[string]bool{}
+	for _, object := range objects {
+		namespaces[object.GetNamespace()] = true
+	}
+
+	var names []string
+	for _, object := range objects {
+		if len(namespaces) > 1 {
+			names = append(names, object.GetNamespace()+"/"+object.GetName())
+		} else {
+			names = append(names, object.GetName())
+		}
+	}
+
+	return names
+}
+
+// describeObjects describes the objects for messages, listing the first few, e.g. "3 pods ('a', 'b', 'c')"
+func describeObjects(resource kubeLockResource, names []string) string {
+	description := fmt.Sprintf("%d %s", len(names), resource)
+	if len(names) == 0 {
+		return description
+	}
+
+	listed := names
+	if len(names) > preflightListLimit {
+		listed = names[:preflightListLimit]
+	}
+	description += " ('" + strings.Join(listed, "', '") + "'"
+	if len(names) > len(listed) {
+		description += fmt.Sprintf(" and %d more", len(names)-len(listed))
+	}
+
+	return description + ")"
+}
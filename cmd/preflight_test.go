@@ -0,0 +1,67 @@
+package cmd
+
+import "testing"
+
+const testPreflightConfig = `
+contexts:
+  - name: prod
+    status: restricted
+profiles:
+  - name: restricted
+    preflightRules:
+      - group: ""
+        resource: pods
+        threshold: 2
+`
+
+func TestPreflight(t *testing.T) {
+	api := newFakeAPIServer(t)
+	setupTestConfig(t, api.Server, testPreflightConfig, "prod")
+
+	api.respond("/api/v1/namespaces/default/pods", `{"kind":"PodList","apiVersion":"v1","items":[{"metadata":{"name":"a"}},{"metadata":{"name":"b"}},{"metadata":{"name":"c"}}]}`)
+	api.respond("/apis/apps/v1/namespaces/default/deployments/web", `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web"},"spec":{"replicas":5}}`)
+
+	config, err := getViperConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := config.Profiles[0]
+
+	tests := []struct {
+		name    string
+		args    []string
+		decided bool
+		allowed bool
+	}{
+		{name: "named pods under the threshold", args: []string{"delete", "pods", "a", "b"}},
+		{name: "selected pods over the threshold", args: []string{"delete", "pods", "-l", "app=web"}, decided: true},
+		{name: "other resources aren't counted", args: []string{"delete", "configmaps", "--all"}},
+		{name: "stdin can't be counted", args: []string{"delete", "-f", "-"}, decided: true},
+		{name: "unresolvable resource can't be counted", args: []string{"delete", "widgets", "a"}, decided: true},
+		{name: "no resources can't be counted", args: []string{"delete"}, decided: true},
+		{name: "scaling to zero counts the pods removed", args: []string{"scale", "deployment", "web", "--replicas=0"}, decided: true},
+		{name: "scaling down a little", args: []string{"scale", "deployment", "web", "--replicas=4"}},
+		{name: "scaling up", args: []string{"scale", "deployment", "web", "--replicas=10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseKubectlRequest(tt.args, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decision, err := evaluatePreflight(profile, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (decision != nil) != tt.decided {
+				t.Fatalf("got decision %+v, want one: %t", decision, tt.decided)
+			}
+			if decision != nil && decision.Allowed != tt.allowed {
+				t.Fatalf("got decision %+v, want allowed: %t", decision, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	diffCreated = "created"
+	diffChanged = "changed"
+	diffDeleted = "deleted"
+
+	colourReset  = "\033[0m"
+	colourBold   = "\033[1m"
+	colourRed    = "\033[31m"
+	colourGreen  = "\033[32m"
+	colourYellow = "\033[33m"
+	colourCyan   = "\033[36m"
+)
+
+// kubeLockDiffObject is an object that 'kubectl diff' shows the command would create, change or delete
+type kubeLockDiffObject struct {
+	// Resource is in kubectl's 'resource.version.group' form, like the targets of manifests
+	Resource  string
+	Kind      string
+	Namespace string
+	Name      string
+	Change    string
+}
+
+func (o kubeLockDiffObject) String() string {
+	if o.Namespace == "" {
+		return o.Kind + " '" + o.Name + "'"
+	}
+
+	return o.Kind + " '" + o.Namespace + "/" + o.Name + "'"
+}
+
+// getDiffVerbs returns the verbs whose manifests 'kubectl diff' can compare with the live objects
+func getDiffVerbs() []string {
+	return []string{"apply", "create", "replace"}
+}
+
+// getDiffFlags returns the flags (by long name) that are passed on to 'kubectl diff'. The rest of the command's flags
+// either don't affect what is diffed, or aren't understood by 'kubectl diff'.
+func getDiffFlags() []string {
+	return []string{"as", "as-group", "as-uid", "certificate-authority", "client-certificate", "client-key", "cluster", "context", "field-manager", "filename", "force-conflicts", "insecure-skip-tls-verify", "kubeconfig", "kustomize", "namespace", "prune", "recursive", "request-timeout", "selector", "server", "server-side", "tls-server-name", "token", "user"}
+}
+
+// evaluateDiffPreview shows what a command that needs confirming (or whose profile always previews) would change, and
+// blocks it if the diff touches objects any of the profiles don't allow, e.g. those generated by kustomize or deleted by
+// '--prune'. The command itself has already been allowed, so only the objects are checked, against the profiles'
+// resource rules. The decision is returned unchanged if there is nothing to diff, and says so in what is confirmed if
+// the diff couldn't be run.
+func evaluateDiffPreview(profiles []KubeLockProfiles, req kubeLockRequest, args []string, decision kubeLockDecision) (kubeLockDecision, error) {
+	objects, ok, err := runDiffPreview(req, args)
+	if err != nil {
+		return confirm("%s Unable to check the diff (%s), so what the command would change is unknown!", decision.Reason, err), nil
+	} else if !ok {
+		return decision, nil
+	}
+
+	for _, object := range objects {
+		objectReq := req
+		if object.Change == diffDeleted {
+			objectReq.Verb = "delete"
+		}
+		objectReq.Resources = []string{object.Resource}
+		objectReq.Names = []string{object.Name}
+		objectReq.Objects = map[string][]string{object.Resource: {object.Name}}
+		objectReq.Namespace = object.Namespace
+		objectReq.Manifests = nil
+		objectReq.UnreadManifests = nil
+
+		for _, profile := range profiles {
+			objectDecision, err := evaluateDiffObject(profile, objectReq, object)
+			if err != nil {
+				return kubeLockDecision{}, err
+			} else if !objectDecision.Allowed {
+				return deny("The diff shows %s would be %s: %s", object, object.Change, objectDecision.Reason), nil
+			}
+		}
+	}
+
+	return decision, nil
+}
+
+// evaluateDiffObject checks an object the diff shows would change against the resource rules of the profile: the
+// allowed resources of an allow-list profile, and the delete exceptions of a block-list profile that blocks deleting
+// (for objects that would be deleted)
+func evaluateDiffObject(profile KubeLockProfiles, req kubeLockRequest, object kubeLockDiffObject) (kubeLockDecision, error) {
+	target := kubeLockTarget{Resource: object.Resource, Names: []string{object.Name}}
+
+	switch {
+	case profileMode(profile) == profileModeAllowList && len(profile.AllowedResources) > 0:
+		ok, err := matchResourceRules(profile.AllowedResources, req, target)
+		if err != nil {
+			return kubeLockDecision{}, err
+		} else if !ok {
+			return deny("Profile '%s' (allow-list mode) does not allow '%s'!", profile.Name, object.Resource), nil
+		}
+	case profileMode(profile) == profileModeBlockList && object.Change == diffDeleted && contains(profile.BlockedVerbs, "delete"):
+		ok, err := matchResourceRules(profile.DeleteExceptions, req, target)
+		if err != nil {
+			return kubeLockDecision{}, err
+		} else if !ok {
+			return deny("Delete exceptions in Profile '%s' (block-list mode) do not allow for deleting '%s'!", profile.Name, object.Resource), nil
+		}
+	}
+
+	return allow("Profile '%s' allows %s to be %s!", profile.Name, object, object.Change), nil
+}
+
+// previewsDiff checks if any of the profiles always previews what commands would change
+func previewsDiff(profiles []KubeLockProfiles) bool {
+	for _, profile := range profiles {
+		if profile.PreviewDiff {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runDiffPreview runs 'kubectl diff' for the command's manifests, prints it and a summary of what would change, and
+// returns the objects that would. The bool returned is false if the command has nothing to diff, and the error is
+// why the diff couldn't be run if it does.
+func runDiffPreview(req kubeLockRequest, args []string) ([]kubeLockDiffObject, bool, error) {
+	if !contains(getDiffVerbs(), req.Verb) || req.SubVerb != "" {
+		return nil, false, nil
+	}
+
+	flags, _ := parseArgs(args, getBoolFlags(), getShortFlagNames())
+	if flags["filename"] == "" && flags["kustomize"] == "" {
+		return nil, false, nil
+	} else if contains(strings.Split(flags["filename"], ","), "-") {
+		return nil, true, errors.New("the manifests are read from stdin, so they can't be diffed as well")
+	}
+
+	kubectlPath, err := findKubectlForArgs(args)
+	if err != nil {
+		return nil, true, err
+	}
+
+	// The diff program is set so the output can be read, whatever the user has chosen for their own diffs.
+	// 'kubectl diff' exits with 1 when it finds differences, and above that when it fails.
+	out, code, err := outputCommand(kubectlPath, diffArgs(flags), "KUBECTL_EXTERNAL_DIFF=diff -u -N")
+	if err != nil {
+		return nil, true, err
+	} else if code > 1 {
+		return nil, true, fmt.Errorf("'kubectl diff' exited with %d", code)
+	}
+
+	colour := useColour()
+	printDiff(out, colour)
+
+	objects := parseDiff(out)
+	printDiffSummary(objects, colour)
+
+	return objects, true, nil
+}
+
+// diffArgs returns the arguments for 'kubectl diff' that compare the same manifests, with the same connection flags
+func diffArgs(flags map[string]string) []string {
+	args := []string{"diff"}
+	for _, name := range getDiffFlags() {
+		value, ok := flags[name]
+		if !ok {
+			continue
+		}
+
+		// Repeated flags are joined with commas when they are parsed
+		values := []string{value}
+		if name == "filename" || name == "as-group" {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			args = append(args, "--"+name+"="+v)
+		}
+	}
+
+	return args
+}
+
+// parseDiff finds the objects in the output of 'kubectl diff'. Each object's diff compares a file named after the
+// object in a 'LIVE' directory with one in a 'MERGED' directory, and one of them is empty if the object would be
+// created or deleted.
+func parseDiff(out []byte) []kubeLockDiffObject {
+	var objects []kubeLockDiffObject
+	var current *kubeLockDiffObject
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "diff "):
+			fields := strings.Fields(line)
+			object, ok := parseDiffFileName(filepath.Base(fields[len(fields)-1]))
+			if !ok {
+				log.Debug("Unable to find the object diffed by '", line, "'")
+				current = nil
+				continue
+			}
+			objects = append(objects, object)
+			current = &objects[len(objects)-1]
+		case current == nil || current.Change != diffChanged || !strings.HasPrefix(line, "@@ "):
+			continue
+		case strings.HasPrefix(line, "@@ -0,0 "):
+			current.Change = diffCreated
+		case strings.HasSuffix(line, " +0,0 @@"):
+			current.Change = diffDeleted
+		}
+	}
+
+	return objects
+}
+
+// parseDiffFileName parses the name kubectl gives an object's file, '[group.]version.Kind.namespace.name'. Groups and
+// names can contain dots, but versions and namespaces can't, so the version is the first part that looks like one.
+func parseDiffFileName(name string) (kubeLockDiffObject, bool) {
+	parts := strings.Split(name, ".")
+	for i := 0; i+3 < len(parts); i++ {
+		if !versionPattern.MatchString(parts[i]) {
+			continue
+		}
+
+		object := kubeLockDiffObject{
+			Resource:  strings.ToLower(parts[i+1]) + "." + parts[i],
+			Kind:      parts[i+1],
+			Namespace: parts[i+2],
+			Name:      strings.Join(parts[i+3:], "."),
+			Change:    diffChanged,
+		}
+		if i > 0 {
+			object.Resource += "." + strings.Join(parts[:i], ".")
+		}
+
+		return object, true
+	}
+
+	return kubeLockDiffObject{}, false
+}
+
+// printDiff prints the diff like 'kubectl diff' would, coloured if it is going to a terminal
+func printDiff(out []byte, colour bool) {
+	if !colour {
+		os.Stdout.Write(out)
+		return
+	}
+
+	for _, line := range strings.SplitAfter(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "+++ "), strings.HasPrefix(line, "--- "):
+			fmt.Print(colourBold, strings.TrimSuffix(line, "\n"), colourReset, "\n")
+		case strings.HasPrefix(line, "@@"):
+			fmt.Print(colourCyan, strings.TrimSuffix(line, "\n"), colourReset, "\n")
+		case strings.HasPrefix(line, "+"):
+			fmt.Print(colourGreen, strings.TrimSuffix(line, "\n"), colourReset, "\n")
+		case strings.HasPrefix(line, "-"):
+			fmt.Print(colourRed, strings.TrimSuffix(line, "\n"), colourReset, "\n")
+		default:
+			fmt.Print(line)
+		}
+	}
+}
+
+// printDiffSummary prints how many objects would be created, changed and deleted, and which they are
+func printDiffSummary(objects []kubeLockDiffObject, colour bool) {
+	counts := map[string]int{}
+	for _, object := range objects {
+		counts[object.Change]++
+	}
+
+	if len(objects) == 0 {
+		log.Info("Diff: no differences from the live objects.")
+		return
+	}
+	log.Info("Diff: ", counts[diffCreated], " to create, ", counts[diffChanged], " to change, ", counts[diffDeleted], " to delete.")
+
+	for _, object := range objects {
+		symbol, code := "~", colourYellow
+		switch object.Change {
+		case diffCreated:
+			symbol, code = "+", colourGreen
+		case diffDeleted:
+			symbol, code = "-", colourRed
+		}
+
+		if colour {
+			fmt.Fprint(os.Stderr, code, "  ", symbol, " ", object, " (", object.Change, ")", colourReset, "\n")
+		} else {
+			fmt.Fprint(os.Stderr, "  ", symbol, " ", object, " (", object.Change, ")\n")
+		}
+	}
+}
+
+// useColour checks if output should be coloured, which it is for a terminal unless NO_COLOR is set
+func useColour() bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,126 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDiff is what 'kubectl diff' shows for a deployment that would be changed, and a configmap that would be
+// created and another deleted (as '--prune' would)
+const testDiff = `diff -u -N /tmp/LIVE-1/apps.v1.Deployment.default.web /tmp/MERGED-1/apps.v1.Deployment.default.web
+--- /tmp/LIVE-1/apps.v1.Deployment.default.web
++++ /tmp/MERGED-1/apps.v1.Deployment.default.web
+@@ -1,3 +1,3 @@
+-  replicas: 2
++  replicas: 3
+diff -u -N /tmp/LIVE-1/v1.ConfigMap.default.new /tmp/MERGED-1/v1.ConfigMap.default.new
+--- /tmp/LIVE-1/v1.ConfigMap.default.new
++++ /tmp/MERGED-1/v1.ConfigMap.default.new
+@@ -0,0 +1,3 @@
++kind: ConfigMap
+diff -u -N /tmp/LIVE-1/v1.ConfigMap.default.old /tmp/MERGED-1/v1.ConfigMap.default.old
+--- /tmp/LIVE-1/v1.ConfigMap.default.old
++++ /tmp/MERGED-1/v1.ConfigMap.default.old
+@@ -1,3 +0,0 @@
+-kind: ConfigMap
+`
+
+// setupTestDiff makes 'kubectl diff' show the test diff, and returns an apply of manifests it is the diff of
+func setupTestDiff(t *testing.T) ([]string, kubeLockRequest) {
+	t.Helper()
+
+	setupTestConfig(t, newFakeAPIServer(t).Server, testProxyConfig, "prod")
+	// The PATH only has the fake kubectl, so the diff is printed with the shell's own printf
+	writeFakeKubectl(t, "printf '%s' '"+testDiff+"'\nexit 1")
+
+	manifest := filepath.Join(t.TempDir(), "manifests.yaml")
+	err := os.WriteFile(manifest, []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  labels:\n    app: web\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"apply", "-f", manifest, "--prune", "-l", "app=web"}
+	req, err := parseKubectlRequest(args, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return args, req
+}
+
+func TestEvaluateDiffPreview(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile KubeLockProfiles
+		allowed bool
+	}{
+		{
+			// The command was allowed by a rule, so blocking its verb doesn't block the objects it changes
+			name:    "blocked verb allowed by a rule",
+			profile: KubeLockProfiles{Name: "p", BlockedVerbs: []string{"apply"}},
+			allowed: true,
+		},
+		{
+			name:    "deleting is blocked",
+			profile: KubeLockProfiles{Name: "p", BlockedVerbs: []string{"delete"}},
+		},
+		{
+			name:    "deleting is an exception",
+			profile: KubeLockProfiles{Name: "p", BlockedVerbs: []string{"delete"}, DeleteExceptions: []KubeLockDeleteExceptions{{Group: "", Resource: "configmaps"}}},
+			allowed: true,
+		},
+		{
+			name:    "resource isn't allowed",
+			profile: KubeLockProfiles{Name: "p", Mode: profileModeAllowList, AllowedVerbs: []string{"apply"}, AllowedResources: []KubeLockDeleteExceptions{{Group: "apps", Resource: "deployments"}}},
+		},
+		{
+			name:    "every resource is allowed",
+			profile: KubeLockProfiles{Name: "p", Mode: profileModeAllowList, AllowedResources: []KubeLockDeleteExceptions{{Group: "*", Resource: "*"}}},
+			allowed: true,
+		},
+	}
+
+	args, req := setupTestDiff(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := evaluateDiffPreview([]KubeLockProfiles{tt.profile}, req, args, confirm("Rule 'apply' asks for confirmation."))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Allowed != tt.allowed {
+				t.Fatalf("got allowed %v, want %v: %s", decision.Allowed, tt.allowed, decision.Reason)
+			}
+		})
+	}
+}
+
+func TestApplyKubectlDecisionPreviewDiff(t *testing.T) {
+
+	args, req := setupTestDiff(t)
+
+	tests := []struct {
+		name        string
+		previewDiff bool
+		ok          bool
+	}{
+		{name: "not previewed", ok: true},
+		// The diff shows a configmap would be deleted, which the profile doesn't allow, without it asking to confirm
+		{name: "always previewed", previewDiff: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := KubeLockProfiles{Name: "p", BlockedVerbs: []string{"delete"}, PreviewDiff: tt.previewDiff}
+			_, ok, err := applyKubectlDecision([]KubeLockProfiles{profile}, req, args, allow("verb 'apply' is not blocked!"), "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// execCommand runs the command attached to the user's terminal in place of kube-lock, exiting with its exit status.
+// It never returns.
+func execCommand(name string, args []string) {
+	path, err := findCommand(name)
+	if err != nil {
+		log.Error(err)
+		os.Exit(127)
+	}
+
+	// Replacing kube-lock with the command leaves nothing in between it and the terminal, so signals, job control and
+	// the exit status are all the command's own
+	err = execProcess(path, args)
+	log.Debug("Unable to exec '", path, "', running it instead: ", err)
+
+	code, err := runCommand(path, args)
+	if err != nil {
+		log.Error("Unable to run '", path, "': ", err)
+		os.Exit(126)
+	}
+	os.Exit(code)
+}
+
+// runCommand runs the command attached to the user's terminal, forwarding the signals kube-lock receives to it, and
+// returns its exit status. It is for commands that kube-lock has more to do after.
+func runCommand(path string, args []string) (int, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Caught before starting the command, so kube-lock can't be killed and leave it running without a terminal.
+	// Signals from the terminal usually reach the command directly too, which kubectl copes with.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals()...)
+	defer signal.Stop(signals)
+
+	err := cmd.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err = cmd.Wait()
+	signal.Stop(signals)
+	close(signals)
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitStatus(exitErr), nil
+	}
+
+	return 0, err
+}
+
+// outputCommand runs the command with its output captured instead of attached to the terminal, with the extra
+// environment variables, and returns the output and its exit status
+func outputCommand(path string, args []string, env ...string) ([]byte, int, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out, exitStatus(exitErr), nil
+	}
+
+	return out, 0, err
+}
+
+// findCommand finds the command to run, reporting a missing command clearly rather than as an exec error
+func findCommand(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%s not found on your PATH", name)
+	} else if err != nil {
+		return "", fmt.Errorf("%s not found: %w", name, err)
+	}
+
+	return path, nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// execProcess can't replace kube-lock with the command on this platform, so it is always run as a child instead
+func execProcess(path string, args []string) error {
+	return errors.New("exec is not supported on this platform")
+}
+
+func forwardedSignals() []os.Signal {
+	return []os.Signal{os.Interrupt}
+}
+
+func exitStatus(err *exec.ExitError) int {
+	return err.ExitCode()
+}
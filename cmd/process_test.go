@@ -0,0 +1,123 @@
+//go:build unix
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// execCommandTestEnv makes the test binary run execCommand, as it never returns
+const execCommandTestEnv = "KUBE_LOCK_TEST_EXEC_COMMAND"
+
+// writeFakeKubectl puts a kubectl that runs the script on the PATH, in place of the real one
+func writeFakeKubectl(t *testing.T, script string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kubectl")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	return path
+}
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		code   int
+	}{
+		{name: "success", script: "exit 0", code: 0},
+		{name: "exit status is kept", script: "exit 3", code: 3},
+		{name: "killed by a signal", script: "kill -TERM $$", code: 128 + 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFakeKubectl(t, tt.script)
+
+			path, err := findCommand("kubectl")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code, err := runCommand(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.code {
+				t.Fatalf("got exit status %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestOutputCommand(t *testing.T) {
+	path := writeFakeKubectl(t, `echo "$KUBE_LOCK_TEST_VALUE $*"; exit 2`)
+
+	out, code, err := outputCommand(path, []string{"diff", "-f", "a.yaml"}, "KUBE_LOCK_TEST_VALUE=set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 2 {
+		t.Fatalf("got exit status %d, want 2", code)
+	}
+	if got := strings.TrimSpace(string(out)); got != "set diff -f a.yaml" {
+		t.Fatalf("got output %q", got)
+	}
+}
+
+func TestFindCommandNotFound(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	_, err := findCommand("kubectl")
+	if err == nil || err.Error() != "kubectl not found on your PATH" {
+		t.Fatalf("got error %v, want kubectl to be reported missing", err)
+	}
+}
+
+func TestExecCommand(t *testing.T) {
+	if os.Getenv(execCommandTestEnv) != "" {
+		execCommand("kubectl", []string{"get", "pods"})
+		return
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		code   int
+		output string
+	}{
+		{name: "kubectl replaces kube-lock", script: `echo "fake kubectl: $*"; exit 7`, code: 7, output: "fake kubectl: get pods"},
+		{name: "kubectl not found", code: 127, output: "kubectl not found on your PATH"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.script != "" {
+				writeFakeKubectl(t, tt.script)
+			} else {
+				t.Setenv("PATH", t.TempDir())
+			}
+
+			test := exec.Command(os.Args[0], "-test.run=^TestExecCommand$")
+			test.Env = append(os.Environ(), execCommandTestEnv+"=1")
+			out, err := test.CombinedOutput()
+
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != tt.code {
+				t.Fatalf("got %v, want exit status %d: %s", err, tt.code, out)
+			}
+			if !strings.Contains(string(out), tt.output) {
+				t.Fatalf("got output %q, want it to contain %q", out, tt.output)
+			}
+		})
+	}
+}
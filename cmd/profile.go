@@ -0,0 +1,562 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// Used for flags.
+	exceptionGroup    string
+	exceptionResource string
+	exceptionNames    []string
+	exceptionSelector string
+	exceptionVerify   bool
+	profileExtends    []string
+	showResolved      bool
+)
+
+func getKubectlVerbs() []string {
+	return []string{"annotate", "api-resources", "api-versions", "apply", "attach", "auth", "auto-scale", "autoscale", "certificate", "cluster-info", "completion", "config", "cordon", "cp", "create", "debug", "delete", "describe", "diff", "drain", "edit", "events", "exec", "explain", "expose", "get", "kustomize", "label", "logs", "patch", "plugin", "port-forward", "proxy", "replace", "rollout", "run", "scale", "set", "taint", "top", "uncordon", "version", "wait"}
+}
+
+// getOCVerbs returns the verbs OpenShift's 'oc' has on top of kubectl's, so profiles can cover it too
+func getOCVerbs() []string {
+	return []string{"adm", "cancel-build", "extract", "idle", "image", "import-image", "login", "logout", "new-app", "new-build", "new-project", "observe", "policy", "process", "project", "projects", "registry", "rsh", "rsync", "secrets", "start-build", "status", "tag", "whoami"}
+}
+
+// profileReadOnly is the built-in profile that only allows reading from the cluster, unless the config defines its own
+const profileReadOnly = "read-only"
+
+// getReadOnlyVerbs returns the verbs that only read from the cluster. 'auth' only does with the subcommands in
+// getReadOnlyAuthVerbs, as 'auth reconcile' writes RBAC.
+func getReadOnlyVerbs() []string {
+	return []string{"api-resources", "api-versions", "auth", "cluster-info", "completion", "describe", "diff", "events", "explain", "get", "logs", "project", "projects", "status", "top", "version", "wait", "whoami"}
+}
+
+func getReadOnlyAuthVerbs() []string {
+	return []string{"can-i", "whoami"}
+}
+
+// isReadOnlyRequest checks if the command only reads from the cluster
+func isReadOnlyRequest(req kubeLockRequest) bool {
+	if req.Verb == "auth" {
+		return contains(getReadOnlyAuthVerbs(), req.SubVerb)
+	}
+
+	return contains(getReadOnlyVerbs(), req.Verb)
+}
+
+func getReadOnlyProfile() KubeLockProfiles {
+	authRule := KubeLockRules{
+		Name:       "auth-read-only",
+		Expression: `request.verb == "auth" && !(request.subverb in ["` + strings.Join(getReadOnlyAuthVerbs(), `", "`) + `"])`,
+		Message:    "only 'auth " + strings.Join(getReadOnlyAuthVerbs(), "' and 'auth ") + "' are read-only",
+	}
+
+	return KubeLockProfiles{Name: profileReadOnly, Mode: profileModeAllowList, AllowedVerbs: getReadOnlyVerbs(), Rules: []KubeLockRules{authRule}}
+}
+
+func init() {
+	rootCmd.AddCommand(profileCmd)
+	profileCmd.AddCommand(profileListCmd)
+	profileCmd.AddCommand(profileShowCmd)
+	profileCmd.AddCommand(profileCreateCmd)
+	profileCmd.AddCommand(profileDeleteCmd)
+	profileCmd.AddCommand(profileAddVerbCmd)
+	profileCmd.AddCommand(profileRemoveVerbCmd)
+	profileCmd.AddCommand(profileAddExceptionCmd)
+	profileCmd.AddCommand(profileRemoveExceptionCmd)
+
+	for _, c := range []*cobra.Command{profileAddExceptionCmd, profileRemoveExceptionCmd} {
+		c.Flags().StringVar(&exceptionGroup, "group", "", "the API group of the resource, which can be a pattern (e.g. 'cert-manager.io' or '*.example.com', and '' for the core group)")
+		c.Flags().StringVar(&exceptionResource, "resource", "", "the plural name of the resource, which can be a pattern (e.g. 'certificates', or '*' for every resource in the group)")
+		c.Flags().StringSliceVar(&exceptionNames, "name", nil, "only allow objects whose names match these patterns (e.g. 'debug-*')")
+		c.Flags().StringVar(&exceptionSelector, "label-selector", "", "only allow objects this label selector selects (e.g. 'kube-lock.io/ephemeral=true')")
+		c.Flags().BoolVar(&exceptionVerify, "verify-labels", false, "check the labels of the live objects when the command names them instead of using a selector")
+		c.MarkFlagRequired("group")
+		c.MarkFlagRequired("resource")
+	}
+
+	profileCreateCmd.Flags().StringSliceVar(&profileExtends, "extends", nil, "profiles the new profile inherits rules from")
+	profileShowCmd.Flags().BoolVar(&showResolved, "resolved", false, "show the effective profile with everything it extends merged in")
+}
+
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage the profiles in the kube-lock config.",
+}
+
+var profileListCmd = &cobra.Command{
+	Use:    "list",
+	Short:  "List the profiles in the kube-lock config and the contexts using them.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := listProfiles()
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileShowCmd = &cobra.Command{
+	Use:               "show <profile>",
+	Short:             "Show the rules of a profile.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := showProfile(args[0], showResolved)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileCreateCmd = &cobra.Command{
+	Use:    "create <profile> [verb...]",
+	Short:  "Create a new profile, optionally with a set of blocked verbs.",
+	Args:   cobra.MinimumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := createProfile(args[0], args[1:], profileExtends)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileDeleteCmd = &cobra.Command{
+	Use:               "delete <profile>",
+	Short:             "Delete a profile that is not in use by any context.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := deleteProfile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileAddVerbCmd = &cobra.Command{
+	Use:               "add-verb <profile> <verb...>",
+	Short:             "Add one or more verbs to the blocked verbs of a (block-list mode) profile.",
+	Args:              cobra.MinimumNArgs(2),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := addProfileVerbs(args[0], args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileRemoveVerbCmd = &cobra.Command{
+	Use:               "remove-verb <profile> <verb...>",
+	Short:             "Remove one or more verbs from the blocked verbs of a (block-list mode) profile.",
+	Args:              cobra.MinimumNArgs(2),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := removeProfileVerbs(args[0], args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileAddExceptionCmd = &cobra.Command{
+	Use:               "add-exception <profile> --group <group> --resource <resource>",
+	Short:             "Add a delete exception to a profile.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := addProfileException(args[0], newException())
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var profileRemoveExceptionCmd = &cobra.Command{
+	Use:               "remove-exception <profile> --group <group> --resource <resource>",
+	Short:             "Remove a delete exception from a profile.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := removeProfileException(args[0], newException())
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// completeProfileNames offers the profile names in the kube-lock config for shell completion
+func completeProfileNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var names []string
+	for _, profile := range config.Profiles {
+		if strings.HasPrefix(profile.Name, toComplete) {
+			names = append(names, profile.Name)
+		}
+	}
+	if findProfileIndex(profileReadOnly, config) == -1 && strings.HasPrefix(profileReadOnly, toComplete) {
+		names = append(names, profileReadOnly)
+	}
+
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+func findProfileIndex(profile string, config KubeLockConfig) int {
+	for i := range config.Profiles {
+		if config.Profiles[i].Name == profile {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// findContextsUsingProfile returns the names of the contexts whose status is set to the profile
+func findContextsUsingProfile(profile string, config KubeLockConfig) []string {
+	var contexts []string
+	for _, context := range config.Contexts {
+		if context.Status == profile {
+			contexts = append(contexts, context.Name)
+		}
+	}
+
+	return contexts
+}
+
+func listProfiles() error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(config.Profiles) == 0 {
+		log.Info("No profiles found in the kube-lock config.")
+		return nil
+	}
+
+	for _, profile := range config.Profiles {
+		name := profile.Name
+		if name == config.DefaultProfile {
+			name += " (default)"
+		}
+
+		contexts := findContextsUsingProfile(profile.Name, config)
+		if len(contexts) > 0 {
+			log.Info(name, ": used by '", strings.Join(contexts, "','"), "'")
+		} else {
+			log.Info(name)
+		}
+	}
+
+	if findProfileIndex(profileReadOnly, config) == -1 {
+		contexts := findContextsUsingProfile(profileReadOnly, config)
+		if len(contexts) > 0 {
+			log.Info(profileReadOnly, " (built-in): used by '", strings.Join(contexts, "','"), "'")
+		} else {
+			log.Info(profileReadOnly, " (built-in)")
+		}
+	}
+
+	return nil
+}
+
+func showProfile(profile string, resolved bool) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	// The built-in 'read-only' profile is used if the config doesn't have its own, as it is when resolved
+	var p KubeLockProfiles
+	index := findProfileIndex(profile, config)
+	if index == -1 && profile == profileReadOnly {
+		p = getReadOnlyProfile()
+	} else if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	} else {
+		p = config.Profiles[index]
+	}
+
+	if resolved {
+		p, err = resolveProfile(profile, config)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(string(out))
+	return nil
+}
+
+func createProfile(profile string, verbs []string, extends []string) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	if profile == "locked" || profile == "unlocked" {
+		return fmt.Errorf("'%s' is a reserved status and cannot be used as a profile name", profile)
+	}
+
+	if findProfileIndex(profile, config) != -1 {
+		return fmt.Errorf("profile '%s' already exists", profile)
+	}
+
+	warnUnknownVerbs(verbs)
+
+	config.Profiles = append(config.Profiles, KubeLockProfiles{Name: profile, Extends: extends, BlockedVerbs: verbs})
+	_, err = resolveProfile(profile, config)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Creating Profile '", profile, "'.")
+	return WriteToConfig(config)
+}
+
+func deleteProfile(profile string) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	index := findProfileIndex(profile, config)
+	if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	}
+
+	contexts := findContextsUsingProfile(profile, config)
+	if len(contexts) > 0 {
+		return fmt.Errorf("profile '%s' is still in use by context(s) '%s'; set them to another profile first", profile, strings.Join(contexts, "','"))
+	}
+
+	profiles := findProfilesExtending(profile, config)
+	if len(profiles) > 0 {
+		return fmt.Errorf("profile '%s' is extended by profile(s) '%s' and cannot be deleted", profile, strings.Join(profiles, "','"))
+	}
+
+	if config.DefaultProfile == profile {
+		return fmt.Errorf("profile '%s' is the default profile and cannot be deleted", profile)
+	}
+
+	log.Info("Deleting Profile '", profile, "'.")
+	config.Profiles = append(config.Profiles[:index], config.Profiles[index+1:]...)
+	return WriteToConfig(config)
+}
+
+func addProfileVerbs(profile string, verbs []string) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	index := findProfileIndex(profile, config)
+	if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	}
+
+	err = checkBlockListProfile(profile, config)
+	if err != nil {
+		return err
+	}
+
+	warnUnknownVerbs(verbs)
+
+	for _, verb := range verbs {
+		if contains(config.Profiles[index].BlockedVerbs, verb) {
+			log.Info("Verb '", verb, "' is already blocked by Profile '", profile, "'.")
+			continue
+		}
+		log.Info("Blocking Verb '", verb, "' in Profile '", profile, "'.")
+		config.Profiles[index].BlockedVerbs = append(config.Profiles[index].BlockedVerbs, verb)
+	}
+
+	return WriteToConfig(config)
+}
+
+func removeProfileVerbs(profile string, verbs []string) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	index := findProfileIndex(profile, config)
+	if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	}
+
+	err = checkBlockListProfile(profile, config)
+	if err != nil {
+		return err
+	}
+
+	var blockedVerbs []string
+	for _, verb := range config.Profiles[index].BlockedVerbs {
+		if contains(verbs, verb) {
+			log.Info("Unblocking Verb '", verb, "' in Profile '", profile, "'.")
+			continue
+		}
+		blockedVerbs = append(blockedVerbs, verb)
+	}
+
+	for _, verb := range verbs {
+		if !contains(config.Profiles[index].BlockedVerbs, verb) {
+			log.Warn("Verb '", verb, "' is not blocked by Profile '", profile, "'.")
+		}
+	}
+
+	config.Profiles[index].BlockedVerbs = blockedVerbs
+	return WriteToConfig(config)
+}
+
+// checkBlockListProfile checks the profile is in block-list mode (itself, or through what it extends), as the verbs it
+// blocks are ignored in allow-list mode, where only its 'allowedVerbs' are allowed
+func checkBlockListProfile(profile string, config KubeLockConfig) error {
+	resolved, err := resolveProfile(profile, config)
+	if err != nil {
+		return err
+	} else if profileMode(resolved) == profileModeAllowList {
+		return fmt.Errorf("profile '%s' is in allow-list mode, so it doesn't block verbs (edit its 'allowedVerbs' in the config instead)", profile)
+	}
+
+	return nil
+}
+
+// newException returns the exception described by the flags
+func newException() KubeLockDeleteExceptions {
+	exception := KubeLockDeleteExceptions{Group: exceptionGroup, Resource: exceptionResource, LabelSelector: exceptionSelector, VerifyLabels: exceptionVerify}
+	if len(exceptionNames) > 0 {
+		exception.Names = exceptionNames
+	}
+
+	return exception
+}
+
+func addProfileException(profile string, exception KubeLockDeleteExceptions) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	index := findProfileIndex(profile, config)
+	if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	}
+
+	if containsException(config.Profiles[index].DeleteExceptions, exception) {
+		log.Info("Delete exception for '", exception.Resource, "' in group '", exception.Group, "' already exists in Profile '", profile, "'.")
+		return nil
+	}
+
+	err = validateExceptionWithDiscovery(exception)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Adding delete exception for '", exception.Resource, "' in group '", exception.Group, "' to Profile '", profile, "'.")
+	config.Profiles[index].DeleteExceptions = append(config.Profiles[index].DeleteExceptions, exception)
+	return WriteToConfig(config)
+}
+
+func removeProfileException(profile string, exception KubeLockDeleteExceptions) error {
+	config, err := getViperConfig()
+	if err != nil {
+		return err
+	}
+
+	index := findProfileIndex(profile, config)
+	if index == -1 {
+		return fmt.Errorf("profile '%s' not found", profile)
+	}
+
+	var found bool
+	var deleteExceptions []KubeLockDeleteExceptions
+	for _, e := range config.Profiles[index].DeleteExceptions {
+		if reflect.DeepEqual(e, exception) {
+			found = true
+			continue
+		}
+		deleteExceptions = append(deleteExceptions, e)
+	}
+
+	if !found {
+		return fmt.Errorf("delete exception for '%s' in group '%s' not found in profile '%s'", exception.Resource, exception.Group, profile)
+	}
+
+	log.Info("Removing delete exception for '", exception.Resource, "' in group '", exception.Group, "' from Profile '", profile, "'.")
+	config.Profiles[index].DeleteExceptions = deleteExceptions
+	return WriteToConfig(config)
+}
+
+// warnUnknownVerbs warns about verbs that kubectl (and oc) don't know about, as they may be typos (or plugins)
+func warnUnknownVerbs(verbs []string) {
+	knownVerbs := append(getKubectlVerbs(), getOCVerbs()...)
+	for _, verb := range verbs {
+		if !contains(knownVerbs, verb) {
+			log.Warn("Verb '", verb, "' is not a known kubectl verb. Adding anyway in case it is a plugin.")
+		}
+	}
+}
+
+// validateExceptionWithDiscovery checks the exception's patterns, and warns if they don't match any resource known to
+// kube-lock or served by the cluster, as it is probably a typo. If the cluster can't be reached, we can't tell.
+func validateExceptionWithDiscovery(exception KubeLockDeleteExceptions) error {
+	if exception.Resource == "" {
+		return errors.New("a resource is required (use '*' for every resource in the group)")
+	}
+
+	if _, err := (kubeLockResource{}).matchesRule(exception); err != nil {
+		return err
+	}
+
+	matched, err := findMatchingResources(exception)
+	if err != nil {
+		log.Warn("Unable to validate delete exception against the cluster: ", err)
+		return nil
+	}
+
+	if len(matched) == 0 {
+		log.Warn("Delete exception for '", exception.Resource, "' in group '", exception.Group, "' doesn't match any resource served by the current cluster.")
+	}
+
+	return nil
+}
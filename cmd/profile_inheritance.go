@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	overrideBlockedVerbs     = "blockedVerbs"
+	overrideDeleteExceptions = "deleteExceptions"
+	overrideAllowedVerbs     = "allowedVerbs"
+	overrideAllowedResources = "allowedResources"
+	overrideRules            = "rules"
+	overrideFlagRules        = "flagRules"
+	overrideBlockedHelmVerbs = "blockedHelmVerbs"
+	overrideAllowedHelmVerbs = "allowedHelmVerbs"
+	overrideHelmExceptions   = "helmExceptions"
+	overridePreflightRules   = "preflightRules"
+)
+
+func getOverridableFields() []string {
+	return []string{overrideBlockedVerbs, overrideDeleteExceptions, overrideAllowedVerbs, overrideAllowedResources, overrideRules, overrideFlagRules, overrideBlockedHelmVerbs, overrideAllowedHelmVerbs, overrideHelmExceptions, overridePreflightRules}
+}
+
+// resolveProfile returns the effective rules of a profile once everything it extends has been merged in.
+//
+// The merge order is:
+//  1. each profile in 'extends' is resolved, and merged in the order it is listed (duplicates are dropped)
+//  2. any field listed in 'override' discards everything inherited for that field
+//  3. the profile's own 'blockedVerbs', 'deleteExceptions', 'allowedVerbs', 'allowedResources', rules', 'flagRules', helm rules and 'preflightRules' are added
+//  4. anything in 'removeBlockedVerbs' and 'removeDeleteExceptions' is taken away
+//
+// The 'mode' is the profile's own if it is set, otherwise that of the last parent which sets one. 'previewDiff' is set
+// if the profile, or any it extends, sets it.
+func resolveProfile(profile string, config KubeLockConfig) (KubeLockProfiles, error) {
+	return resolveProfileWithPath(profile, config, nil)
+}
+
+func resolveProfileWithPath(profile string, config KubeLockConfig, path []string) (KubeLockProfiles, error) {
+	if contains(path, profile) {
+		return KubeLockProfiles{}, fmt.Errorf("profile inheritance cycle detected: %s -> %s", strings.Join(path, " -> "), profile)
+	}
+	path = append(path, profile)
+
+	index := findProfileIndex(profile, config)
+	if index == -1 && profile == profileReadOnly {
+		return getReadOnlyProfile(), nil
+	} else if index == -1 {
+		if len(path) > 1 {
+			return KubeLockProfiles{}, fmt.Errorf("profile '%s' extends profile '%s', which does not exist", path[len(path)-2], profile)
+		}
+		return KubeLockProfiles{}, fmt.Errorf("profile '%s' not found", profile)
+	}
+	own := config.Profiles[index]
+
+	for _, field := range own.Override {
+		if !contains(getOverridableFields(), field) {
+			return KubeLockProfiles{}, fmt.Errorf("profile '%s' overrides unknown field '%s' (must be one of '%s')", profile, field, strings.Join(getOverridableFields(), "','"))
+		}
+	}
+
+	resolved := KubeLockProfiles{Name: own.Name, Extends: own.Extends}
+	for _, parent := range own.Extends {
+		parentProfile, err := resolveProfileWithPath(parent, config, path)
+		if err != nil {
+			return KubeLockProfiles{}, err
+		}
+		resolved.BlockedVerbs = appendUniqueStrings(resolved.BlockedVerbs, parentProfile.BlockedVerbs...)
+		resolved.DeleteExceptions = appendUniqueExceptions(resolved.DeleteExceptions, parentProfile.DeleteExceptions...)
+		resolved.AllowedVerbs = appendUniqueStrings(resolved.AllowedVerbs, parentProfile.AllowedVerbs...)
+		resolved.AllowedResources = appendUniqueExceptions(resolved.AllowedResources, parentProfile.AllowedResources...)
+		resolved.Rules = append(resolved.Rules, parentProfile.Rules...)
+		resolved.FlagRules = append(resolved.FlagRules, parentProfile.FlagRules...)
+		resolved.BlockedHelmVerbs = appendUniqueStrings(resolved.BlockedHelmVerbs, parentProfile.BlockedHelmVerbs...)
+		resolved.AllowedHelmVerbs = appendUniqueStrings(resolved.AllowedHelmVerbs, parentProfile.AllowedHelmVerbs...)
+		resolved.HelmExceptions = append(resolved.HelmExceptions, parentProfile.HelmExceptions...)
+		resolved.PreflightRules = append(resolved.PreflightRules, parentProfile.PreflightRules...)
+		if parentProfile.Mode != "" {
+			resolved.Mode = parentProfile.Mode
+		}
+		resolved.PreviewDiff = resolved.PreviewDiff || parentProfile.PreviewDiff
+	}
+
+	if own.Mode != "" {
+		resolved.Mode = own.Mode
+	}
+	resolved.PreviewDiff = resolved.PreviewDiff || own.PreviewDiff
+
+	if contains(own.Override, overrideBlockedVerbs) {
+		resolved.BlockedVerbs = nil
+	}
+	if contains(own.Override, overrideDeleteExceptions) {
+		resolved.DeleteExceptions = nil
+	}
+	if contains(own.Override, overrideAllowedVerbs) {
+		resolved.AllowedVerbs = nil
+	}
+	if contains(own.Override, overrideAllowedResources) {
+		resolved.AllowedResources = nil
+	}
+	if contains(own.Override, overrideRules) {
+		resolved.Rules = nil
+	}
+	if contains(own.Override, overrideFlagRules) {
+		resolved.FlagRules = nil
+	}
+	if contains(own.Override, overrideBlockedHelmVerbs) {
+		resolved.BlockedHelmVerbs = nil
+	}
+	if contains(own.Override, overrideAllowedHelmVerbs) {
+		resolved.AllowedHelmVerbs = nil
+	}
+	if contains(own.Override, overrideHelmExceptions) {
+		resolved.HelmExceptions = nil
+	}
+	if contains(own.Override, overridePreflightRules) {
+		resolved.PreflightRules = nil
+	}
+
+	resolved.BlockedVerbs = appendUniqueStrings(resolved.BlockedVerbs, own.BlockedVerbs...)
+	resolved.DeleteExceptions = appendUniqueExceptions(resolved.DeleteExceptions, own.DeleteExceptions...)
+	resolved.AllowedVerbs = appendUniqueStrings(resolved.AllowedVerbs, own.AllowedVerbs...)
+	resolved.AllowedResources = appendUniqueExceptions(resolved.AllowedResources, own.AllowedResources...)
+	resolved.Rules = append(resolved.Rules, own.Rules...)
+	resolved.FlagRules = append(resolved.FlagRules, own.FlagRules...)
+	resolved.BlockedHelmVerbs = appendUniqueStrings(resolved.BlockedHelmVerbs, own.BlockedHelmVerbs...)
+	resolved.AllowedHelmVerbs = appendUniqueStrings(resolved.AllowedHelmVerbs, own.AllowedHelmVerbs...)
+	resolved.HelmExceptions = append(resolved.HelmExceptions, own.HelmExceptions...)
+	resolved.PreflightRules = append(resolved.PreflightRules, own.PreflightRules...)
+
+	resolved.BlockedVerbs = removeStrings(resolved.BlockedVerbs, own.RemoveBlockedVerbs)
+	resolved.DeleteExceptions = removeExceptions(resolved.DeleteExceptions, own.RemoveDeleteExceptions)
+
+	return resolved, nil
+}
+
+// findProfilesExtending returns the names of the profiles that directly extend the profile
+func findProfilesExtending(profile string, config KubeLockConfig) []string {
+	var profiles []string
+	for _, p := range config.Profiles {
+		if contains(p.Extends, profile) {
+			profiles = append(profiles, p.Name)
+		}
+	}
+
+	return profiles
+}
+
+func appendUniqueStrings(s []string, values ...string) []string {
+	for _, v := range values {
+		if !contains(s, v) {
+			s = append(s, v)
+		}
+	}
+
+	return s
+}
+
+func removeStrings(s []string, values []string) []string {
+	var out []string
+	for _, v := range s {
+		if !contains(values, v) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
+
+func containsException(s []KubeLockDeleteExceptions, exception KubeLockDeleteExceptions) bool {
+	for _, e := range s {
+		if reflect.DeepEqual(e, exception) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendUniqueExceptions(s []KubeLockDeleteExceptions, values ...KubeLockDeleteExceptions) []KubeLockDeleteExceptions {
+	for _, v := range values {
+		if !containsException(s, v) {
+			s = append(s, v)
+		}
+	}
+
+	return s
+}
+
+func removeExceptions(s []KubeLockDeleteExceptions, values []KubeLockDeleteExceptions) []KubeLockDeleteExceptions {
+	var out []KubeLockDeleteExceptions
+	for _, v := range s {
+		if !containsException(values, v) {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
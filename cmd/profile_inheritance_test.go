@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveProfile(t *testing.T) {
+	pods := KubeLockDeleteExceptions{Group: "", Resource: "pods"}
+	jobs := KubeLockDeleteExceptions{Group: "batch", Resource: "jobs"}
+	config := KubeLockConfig{Profiles: []KubeLockProfiles{
+		{Name: "base", BlockedVerbs: []string{"delete", "drain"}, DeleteExceptions: []KubeLockDeleteExceptions{pods}, Mode: profileModeBlockList},
+		{Name: "writes", BlockedVerbs: []string{"apply", "delete"}, DeleteExceptions: []KubeLockDeleteExceptions{jobs}},
+		{Name: "both", Extends: []string{"base", "writes"}, BlockedVerbs: []string{"scale"}},
+		{Name: "overridden", Extends: []string{"base"}, Override: []string{overrideBlockedVerbs}, BlockedVerbs: []string{"cordon"}},
+		{Name: "removed", Extends: []string{"both"}, RemoveBlockedVerbs: []string{"drain"}, RemoveDeleteExceptions: []KubeLockDeleteExceptions{pods}},
+		{Name: "previewed", Extends: []string{"base"}, PreviewDiff: true},
+		{Name: "from-preview", Extends: []string{"previewed"}},
+		{Name: "allow", Mode: profileModeAllowList, AllowedVerbs: []string{"get"}},
+		{Name: "mode-inherited", Extends: []string{"allow"}},
+		{Name: "a", Extends: []string{"b"}},
+		{Name: "b", Extends: []string{"c"}},
+		{Name: "c", Extends: []string{"a"}},
+		{Name: "self", Extends: []string{"self"}},
+		{Name: "orphan", Extends: []string{"missing"}},
+		{Name: "bad-override", Override: []string{"mode"}},
+	}}
+
+	tests := []struct {
+		name       string
+		profile    string
+		blocked    []string
+		exceptions []KubeLockDeleteExceptions
+		mode       string
+		preview    bool
+		err        string
+	}{
+		{name: "without parents", profile: "base", blocked: []string{"delete", "drain"}, exceptions: []KubeLockDeleteExceptions{pods}, mode: profileModeBlockList},
+		{name: "parents merged in order without duplicates", profile: "both", blocked: []string{"delete", "drain", "apply", "scale"}, exceptions: []KubeLockDeleteExceptions{pods, jobs}, mode: profileModeBlockList},
+		{name: "override discards what is inherited", profile: "overridden", blocked: []string{"cordon"}, exceptions: []KubeLockDeleteExceptions{pods}, mode: profileModeBlockList},
+		{name: "remove takes away what is inherited", profile: "removed", blocked: []string{"delete", "apply", "scale"}, exceptions: []KubeLockDeleteExceptions{jobs}, mode: profileModeBlockList},
+		{name: "preview diff is inherited", profile: "from-preview", blocked: []string{"delete", "drain"}, exceptions: []KubeLockDeleteExceptions{pods}, mode: profileModeBlockList, preview: true},
+		{name: "mode is inherited", profile: "mode-inherited", mode: profileModeAllowList},
+		{name: "built-in read-only", profile: profileReadOnly, mode: profileModeAllowList},
+		{name: "cycle", profile: "a", err: "cycle detected: a -> b -> c -> a"},
+		{name: "extends itself", profile: "self", err: "cycle detected: self -> self"},
+		{name: "missing parent", profile: "orphan", err: "extends profile 'missing', which does not exist"},
+		{name: "missing profile", profile: "missing", err: "profile 'missing' not found"},
+		{name: "unknown override", profile: "bad-override", err: "overrides unknown field 'mode'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := resolveProfile(tt.profile, config)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.profile == profileReadOnly {
+				if !reflect.DeepEqual(resolved, getReadOnlyProfile()) {
+					t.Fatalf("got %+v, want the built-in read-only profile", resolved)
+				}
+				return
+			}
+			if !reflect.DeepEqual(resolved.BlockedVerbs, tt.blocked) {
+				t.Errorf("got blocked verbs %v, want %v", resolved.BlockedVerbs, tt.blocked)
+			}
+			if !reflect.DeepEqual(resolved.DeleteExceptions, tt.exceptions) {
+				t.Errorf("got delete exceptions %v, want %v", resolved.DeleteExceptions, tt.exceptions)
+			}
+			if resolved.Mode != tt.mode || resolved.PreviewDiff != tt.preview {
+				t.Errorf("got mode %q and preview %v, want %q and %v", resolved.Mode, resolved.PreviewDiff, tt.mode, tt.preview)
+			}
+		})
+	}
+}
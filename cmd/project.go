@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// projectConfigName is the name of a project's config, which is looked for from the working directory upwards
+const projectConfigName = ".kube-lock.yaml"
+
+// KubeLockProject is a project's config, which applies to commands run from inside the project. It can only make
+// kube-lock stricter: it pins the contexts the project may use, and adds rules that apply on top of the context's own,
+// whatever its status.
+type KubeLockProject struct {
+	AllowedContexts []string            `yaml:"allowedContexts,omitempty"`
+	BlockedVerbs    []string            `yaml:"blockedVerbs,omitempty"`
+	Rules           []KubeLockRules     `yaml:"rules,omitempty"`
+	FlagRules       []KubeLockFlagRules `yaml:"flagRules,omitempty"`
+	Source          string              `yaml:"-" mapstructure:"-"`
+}
+
+// findProjectConfig looks for a project's config from the working directory upwards, like '.editorconfig'. The
+// user's own config is skipped, as it is in the home directory with the same name.
+func findProjectConfig() (string, bool) {
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Debug("Unable to find the working directory, so no project config is used: ", err)
+		return "", false
+	}
+
+	var skip []os.FileInfo
+	if home, err := os.UserHomeDir(); err == nil {
+		if info, err := os.Stat(filepath.Join(home, projectConfigName)); err == nil {
+			skip = append(skip, info)
+		}
+	}
+	if info, err := os.Stat(viper.ConfigFileUsed()); err == nil {
+		skip = append(skip, info)
+	}
+
+	for {
+		file := filepath.Join(dir, projectConfigName)
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() && !sameFileAsAny(info, skip) {
+			return file, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+		dir = parent
+	}
+}
+
+func sameFileAsAny(info os.FileInfo, others []os.FileInfo) bool {
+	for _, other := range others {
+		if os.SameFile(info, other) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readProjectConfig reads the project's config, if there is one
+func readProjectConfig() (*KubeLockProject, error) {
+	file, ok := findProjectConfig()
+	if !ok {
+		return nil, nil
+	}
+	log.Debug("Using project config: ", file)
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the project config '%s': %w", file, err)
+	}
+
+	project := KubeLockProject{Source: file}
+	err = v.Unmarshal(&project)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the project config '%s': %w", file, err)
+	}
+
+	return &project, nil
+}
+
+// validateProject checks that the project's config is usable, and that it can only make kube-lock stricter
+func validateProject(config KubeLockConfig) error {
+	project := config.Project
+	if project == nil {
+		return nil
+	}
+
+	for _, pattern := range project.AllowedContexts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("project config '%s' has invalid allowed context '%s': %w", project.Source, pattern, err)
+		}
+	}
+
+	for i, rule := range project.Rules {
+		if ruleAction(rule.Action) == ruleActionAllow {
+			return fmt.Errorf("rule #%d in project config '%s' allows commands, but a project can only make kube-lock stricter", i+1, project.Source)
+		}
+	}
+
+	projectConfig := KubeLockConfig{Profiles: []KubeLockProfiles{projectProfile(*project)}}
+	err := validateRules(projectConfig)
+	if err != nil {
+		return err
+	}
+
+	return validateFlagRules(projectConfig)
+}
+
+// projectProfile returns the profile the project's rules are evaluated as
+func projectProfile(project KubeLockProject) KubeLockProfiles {
+	return KubeLockProfiles{Name: project.Source, BlockedVerbs: project.BlockedVerbs, Rules: project.Rules, FlagRules: project.FlagRules}
+}
+
+// projectAllowsContext checks the project (if there is one) allows the context
+func projectAllowsContext(project *KubeLockProject, kubeContext string) bool {
+	return project == nil || len(project.AllowedContexts) == 0 || matchGlobs(project.AllowedContexts, kubeContext)
+}
+
+// checkProjectContext checks the project allows the context, reporting it if it doesn't
+func checkProjectContext(project *KubeLockProject, kubeContext string) bool {
+	if projectAllowsContext(project, kubeContext) {
+		return true
+	}
+
+	log.Error("Halt! Project config '", project.Source, "' only allows the context(s) '", strings.Join(project.AllowedContexts, "', '"), "', not '", kubeContext, "'. Exiting...")
+	return false
+}
+
+// evaluateProject evaluates the kubectl command against the project's rules too, if there is a project, and combines
+// the decision with the context's, so whatever either asks for is applied once. It returns the profiles the command
+// has been evaluated against.
+func evaluateProject(project *KubeLockProject, req kubeLockRequest, profiles []KubeLockProfiles, decision kubeLockDecision) ([]KubeLockProfiles, kubeLockDecision, error) {
+	if project == nil {
+		return profiles, decision, nil
+	}
+
+	profile := projectProfile(*project)
+	projectDecision, err := evaluateProfile(profile, req)
+	if err != nil {
+		return nil, kubeLockDecision{}, err
+	}
+
+	return append(profiles, profile), combineDecisions(decision, projectDecision), nil
+}
+
+// combineDecisions combines two decisions about the same command. It is denied if either denies it, and run as a
+// dry-run if either only allows that (which leaves nothing to confirm), or else confirmed if either asks for it.
+func combineDecisions(a kubeLockDecision, b kubeLockDecision) kubeLockDecision {
+	switch {
+	case !a.Allowed:
+		return a
+	case !b.Allowed:
+		return b
+	case a.DryRun && b.DryRun:
+		return dryRun("%s %s", a.Reason, b.Reason)
+	case a.DryRun:
+		return a
+	case b.DryRun:
+		return b
+	case a.Confirm && b.Confirm:
+		return confirm("%s %s", a.Reason, b.Reason)
+	case b.Confirm:
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCombineDecisions(t *testing.T) {
+	tests := []struct {
+		name string
+		a    kubeLockDecision
+		b    kubeLockDecision
+		want kubeLockDecision
+	}{
+		{name: "both allow", a: allow("a"), b: allow("b"), want: allow("a")},
+		{name: "the first denies", a: deny("a"), b: confirm("b"), want: deny("a")},
+		{name: "the second denies", a: dryRun("a"), b: deny("b"), want: deny("b")},
+		{name: "both deny", a: deny("a"), b: deny("b"), want: deny("a")},
+		{name: "a dry-run over a confirmation", a: confirm("a"), b: dryRun("b"), want: dryRun("b")},
+		{name: "a dry-run over an allow", a: dryRun("a"), b: allow("b"), want: dryRun("a")},
+		{name: "both dry-run", a: dryRun("a"), b: dryRun("b"), want: dryRun("a b")},
+		{name: "the first confirms", a: confirm("a"), b: allow("b"), want: confirm("a")},
+		{name: "the second confirms", a: allow("a"), b: confirm("b"), want: confirm("b")},
+		{name: "both confirm", a: confirm("a"), b: confirm("b"), want: confirm("a b")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := combineDecisions(tt.a, tt.b); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateProject(t *testing.T) {
+	// Without a current context, resources are only resolved from the catalogue
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "kubeconfig"))
+
+	project := &KubeLockProject{Source: "project", BlockedVerbs: []string{"delete"}, Rules: []KubeLockRules{
+		{Name: "confirm-scale", Expression: `request.verb == "scale"`, Action: ruleActionConfirm},
+	}}
+	profiles := []KubeLockProfiles{{Name: "context"}}
+
+	tests := []struct {
+		name     string
+		project  *KubeLockProject
+		args     []string
+		decision kubeLockDecision
+		want     kubeLockDecision
+		profiles int
+	}{
+		{name: "no project", args: []string{"delete", "pods", "a"}, decision: confirm("context"), want: confirm("context"), profiles: 1},
+		{name: "the project denies", project: project, args: []string{"delete", "pods", "a"}, decision: allow("context"), want: deny(""), profiles: 2},
+		{name: "the project confirms", project: project, args: []string{"scale", "deployment", "web", "--replicas=2"}, decision: allow("context"), want: confirm(""), profiles: 2},
+		{name: "the context dry-runs", project: project, args: []string{"scale", "deployment", "web", "--replicas=2"}, decision: dryRun("context"), want: dryRun("context"), profiles: 2},
+		{name: "the context denies", project: project, args: []string{"get", "pods"}, decision: deny("context"), want: deny("context"), profiles: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseKubectlRequest(tt.args, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			evaluated, decision, err := evaluateProject(tt.project, req, profiles, tt.decision)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(evaluated) != tt.profiles {
+				t.Fatalf("got %d profiles, want %d", len(evaluated), tt.profiles)
+			}
+			// The project's own reasons are left to its rules' tests
+			if tt.want.Reason == "" {
+				decision.Reason = ""
+			}
+			if decision != tt.want {
+				t.Fatalf("got %+v, want %+v", decision, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v3"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultPromptFormat = "{{.Symbol}}"
+
+var (
+	// Used for flags.
+	promptFormat string
+)
+
+// promptState is what the prompt is rendered from. It is cached on disk, keyed on the kubeconfig and every kube-lock
+// config layered into the config (including the project's), so most prompts don't have to parse any of them.
+type promptState struct {
+	KubeconfigPath      string             `json:"kubeconfigPath"`
+	KubeconfigModified  time.Time          `json:"kubeconfigModified"`
+	ConfigFiles         []promptConfigFile `json:"configFiles"`
+	Context             string             `json:"context"`
+	Status              string             `json:"status"`
+	UnlockTimestamp     string             `json:"unlockTimestamp"`
+	UnlockTimeoutPeriod string             `json:"unlockTimeoutPeriod"`
+	// ProjectBlocked is set when the project the prompt is in doesn't allow the context
+	ProjectBlocked bool `json:"projectBlocked,omitempty"`
+}
+
+// promptConfigFile is one of the files the config was read from, and when it was last changed
+type promptConfigFile struct {
+	Path     string    `json:"path"`
+	Modified time.Time `json:"modified"`
+}
+
+// promptData are the fields available to '--format'
+type promptData struct {
+	Context   string
+	Status    string
+	Profile   string
+	Remaining string
+	Symbol    string
+}
+
+func init() {
+	rootCmd.AddCommand(promptCmd)
+	promptCmd.AddCommand(promptInitCmd)
+	promptCmd.PersistentFlags().StringVar(&promptFormat, "format", defaultPromptFormat, "the Go template to render, with the fields .Context, .Status, .Profile, .Remaining and .Symbol")
+}
+
+var promptCmd = &cobra.Command{
+	Use:   "prompt",
+	Short: "Print the lock status of the current context for your shell prompt.",
+	Long: "Prints the lock status of the current context for your shell prompt: 🔒 when it is locked, 🔓 when it is unlocked (with the time left if unlocks time out), or the name of its profile. " +
+		"It shows ⛔ when the config of the project you are in doesn't allow the context.\n\n" +
+		"It doesn't run kubectl, and caches what it reads on disk so it only takes a few milliseconds. " +
+		"Use 'kubectl-lock prompt init <shell>' to add it to your prompt, or for starship add a custom module:\n\n" +
+		"  [custom.kube_lock]\n  command = \"kubectl-lock prompt\"\n  when = true",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := printPrompt(viper.ConfigFileUsed(), context, promptFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var promptInitCmd = &cobra.Command{
+	Use:       "init <bash|zsh|fish>",
+	Short:     "Print the snippet that adds the kube-lock status to your shell prompt.",
+	Long:      "Prints the snippet that adds the kube-lock status to your shell prompt. Add it to your shell's rc file, e.g.\n\n  eval \"$(kubectl-lock prompt init bash)\"",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"bash", "zsh", "fish"},
+	PreRun:    toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		snippet, err := promptInitSnippet(args[0], promptFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(snippet)
+	},
+}
+
+// runPromptFastPath prints the prompt without setting up cobra and viper, which would slow every shell prompt down.
+// It returns false for anything it doesn't understand, so the command is run as normal.
+func runPromptFastPath(args []string) bool {
+	if len(args) == 0 || args[0] != "prompt" {
+		return false
+	}
+
+	var configPath, kubeContext string
+	format := defaultPromptFormat
+	for i := 1; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(args[i], "=")
+		if !hasValue {
+			if i+1 >= len(args) {
+				return false
+			}
+			value = args[i+1]
+			i++
+		}
+
+		switch name {
+		case "--format":
+			format = value
+		case "--config":
+			configPath = value
+		case "--context":
+			kubeContext = value
+		default:
+			return false
+		}
+	}
+
+	err := printPrompt(configPath, kubeContext, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return true
+}
+
+func printPrompt(configPath string, kubeContext string, format string) error {
+	tmpl, err := template.New("prompt").Parse(format)
+	if err != nil {
+		return err
+	}
+
+	if configPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		configPath = filepath.Join(home, ".kube-lock.yaml")
+	}
+
+	state, err := loadPromptState(configPath, kubeContext)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(os.Stdout, newPromptData(state, time.Now()))
+}
+
+// loadPromptState returns the state from the cache if none of the configs have changed since it was written, and
+// otherwise reads the configs and updates the cache
+func loadPromptState(configPath string, kubeContext string) (promptState, error) {
+	viper.SetConfigFile(configPath)
+	viper.SetConfigType("yaml")
+
+	kubeconfigPath := findPromptKubeconfig()
+	state := promptState{KubeconfigPath: kubeconfigPath, ConfigFiles: findPromptConfigFiles(configPath)}
+	if info, err := os.Stat(kubeconfigPath); err == nil {
+		state.KubeconfigModified = info.ModTime()
+	}
+
+	cachePath, err := getPromptCachePath()
+	if err != nil {
+		return state, err
+	}
+
+	// The cache only holds the current context, so a context given with '--context' isn't cached
+	if kubeContext == "" {
+		if cached, ok := readPromptCache(cachePath); ok && cached.KubeconfigPath == state.KubeconfigPath && cached.KubeconfigModified.Equal(state.KubeconfigModified) &&
+			reflect.DeepEqual(cached.ConfigFiles, state.ConfigFiles) {
+			return cached, nil
+		}
+	}
+
+	state.Context = kubeContext
+	if state.Context == "" {
+		state.Context = readCurrentContext(kubeconfigPath)
+	}
+
+	// The config is read the same way as for every other command, so the prompt shows what they would do
+	if _, err := os.Stat(configPath); err == nil {
+		err = viper.ReadInConfig()
+		if err != nil {
+			return state, err
+		}
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return state, err
+	}
+
+	state.UnlockTimeoutPeriod = config.UnlockTimeoutPeriod
+	if status, unlockTimestamp, found := lookupContextStatus(state.Context, config); found {
+		state.Status = status
+		state.UnlockTimestamp = unlockTimestamp
+	}
+	state.ProjectBlocked = !projectAllowsContext(config.Project, state.Context)
+
+	if kubeContext == "" {
+		writePromptCache(cachePath, state)
+	}
+
+	return state, nil
+}
+
+// findPromptConfigFiles returns the files the config is read from, which are the user's config, the system and team
+// configs layered under it, and the config of the project the prompt is in
+func findPromptConfigFiles(configPath string) []promptConfigFile {
+	paths := []string{configPath}
+	if _, err := os.Stat(systemConfigPath); err == nil {
+		paths = append(paths, systemConfigPath)
+	}
+	if policyDir, _ := findPolicyDir(); policyDir != "" {
+		// The directory itself is there too, so the cache is missed when files are added to it or removed from it
+		paths = append(paths, policyDir)
+		if files, err := findPolicyFiles(policyDir); err == nil {
+			paths = append(paths, files...)
+		}
+		if signaturePath, err := policySignaturePath(policyDir); err == nil {
+			paths = append(paths, signaturePath)
+		}
+	}
+	if project, ok := findProjectConfig(); ok {
+		paths = append(paths, project)
+	}
+
+	files := make([]promptConfigFile, 0, len(paths))
+	for _, path := range paths {
+		file := promptConfigFile{Path: path}
+		if info, err := os.Stat(path); err == nil {
+			file.Modified = info.ModTime()
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// newPromptData works out what to show for the state, as of now
+func newPromptData(state promptState, now time.Time) promptData {
+	data := promptData{Context: state.Context, Status: state.Status}
+
+	if state.ProjectBlocked {
+		data.Status = "blocked"
+		data.Symbol = "⛔"
+		return data
+	}
+
+	switch state.Status {
+	case "":
+		// Contexts kube-lock doesn't know about yet show nothing
+	case "locked":
+		data.Symbol = "🔒"
+	case "unlocked":
+		data.Symbol = "🔓"
+		if remaining, ok := unlockRemaining(state, now); ok && remaining <= 0 {
+			// The unlock has expired, and the next command will lock the context again
+			data.Status = "locked"
+			data.Symbol = "🔒"
+		} else if ok {
+			data.Remaining = formatRemaining(remaining)
+			data.Symbol += " (" + data.Remaining + " left)"
+		}
+	default:
+		data.Profile = state.Status
+		data.Symbol = state.Status
+	}
+
+	return data
+}
+
+// unlockRemaining returns how long is left until the context's unlock times out, if it does
+func unlockRemaining(state promptState, now time.Time) (time.Duration, bool) {
+	if state.UnlockTimeoutPeriod == "" || state.UnlockTimestamp == "" {
+		return 0, false
+	}
+
+	unlockTime, err := time.Parse(timestampLayout, state.UnlockTimestamp)
+	if err != nil {
+		return 0, false
+	}
+
+	timeout, err := time.ParseDuration(state.UnlockTimeoutPeriod)
+	if err != nil {
+		return 0, false
+	}
+
+	return unlockTime.Add(timeout).Sub(now), true
+}
+
+// formatRemaining rounds the time left to something short enough for a prompt, e.g. '1h5m', '12m' or '40s'
+func formatRemaining(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+
+	s := d.Round(time.Minute).String()
+	return strings.TrimSuffix(s, "0s")
+}
+
+// findPromptKubeconfig returns the kubeconfig file the current context is read from
+func findPromptKubeconfig() string {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path
+		}
+	}
+
+	return clientcmd.RecommendedHomeFile
+}
+
+// readCurrentContext reads only the current context from the kubeconfig, which is much quicker than loading it
+func readCurrentContext(kubeconfigPath string) string {
+	data, err := os.ReadFile(kubeconfigPath)
+	if err != nil {
+		return ""
+	}
+
+	var kubeConfig struct {
+		CurrentContext string `yaml:"current-context"`
+	}
+	if yaml.Unmarshal(data, &kubeConfig) != nil {
+		return ""
+	}
+
+	return kubeConfig.CurrentContext
+}
+
+func getPromptCachePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".kube-lock", "prompt-cache.json"), nil
+}
+
+func readPromptCache(cachePath string) (promptState, bool) {
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		return promptState{}, false
+	}
+
+	var state promptState
+	if json.Unmarshal(data, &state) != nil {
+		return promptState{}, false
+	}
+
+	return state, true
+}
+
+// writePromptCache writes the cache, ignoring failures as the prompt can always be worked out without it
+func writePromptCache(cachePath string, state promptState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+
+	if os.MkdirAll(filepath.Dir(cachePath), 0700) != nil {
+		return
+	}
+
+	// Written to a temporary file first, so prompts in other shells never read half a cache
+	tmp := cachePath + ".tmp"
+	if os.WriteFile(tmp, data, 0600) != nil {
+		return
+	}
+	os.Rename(tmp, cachePath)
+}
+
+// promptInitSnippet returns the shell code that keeps $KUBE_LOCK_PROMPT up to date before every prompt
+func promptInitSnippet(shell string, format string) (string, error) {
+	command := "kubectl-lock prompt"
+	if format != defaultPromptFormat {
+		command += " --format " + shellQuote(format)
+	}
+
+	switch shell {
+	case "bash":
+		return "__kube_lock_prompt() { KUBE_LOCK_PROMPT=\"$(" + command + " 2>/dev/null)\"; }\n" +
+			"PROMPT_COMMAND=\"__kube_lock_prompt${PROMPT_COMMAND:+;$PROMPT_COMMAND}\"\n" +
+			"# Add ${KUBE_LOCK_PROMPT} to your PS1, e.g. PS1='${KUBE_LOCK_PROMPT} '\"$PS1\"\n", nil
+	case "zsh":
+		return "autoload -Uz add-zsh-hook\n" +
+			"setopt PROMPT_SUBST\n" +
+			"__kube_lock_prompt() { KUBE_LOCK_PROMPT=\"$(" + command + " 2>/dev/null)\" }\n" +
+			"add-zsh-hook precmd __kube_lock_prompt\n" +
+			"# Add ${KUBE_LOCK_PROMPT} to your PROMPT or RPROMPT, e.g. RPROMPT='${KUBE_LOCK_PROMPT}'\n", nil
+	case "fish":
+		return "function __kube_lock_prompt --on-event fish_prompt\n" +
+			"    set -g KUBE_LOCK_PROMPT (" + command + " 2>/dev/null)\n" +
+			"end\n" +
+			"# Add $KUBE_LOCK_PROMPT to your fish_prompt or fish_right_prompt, e.g. echo -n $KUBE_LOCK_PROMPT\n", nil
+	default:
+		return "", fmt.Errorf("unsupported shell '%s' (must be 'bash', 'zsh' or 'fish')", shell)
+	}
+}
+
+// shellQuote quotes a string so bash, zsh and fish all read it literally
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
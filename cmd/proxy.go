@@ -0,0 +1,715 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	proxyContextPrefix = "/contexts/"
+	// proxyReadOnlyPrefix routes a context through the proxy with only the 'read-only' profile, whatever its status
+	proxyReadOnlyPrefix = "/read-only"
+	proxyUserName       = "kube-lock-proxy"
+	// proxyTokenFile holds the token clients must send to the proxy. A new one is made every time the proxy starts.
+	proxyTokenFile = "token"
+	// proxyReadOnlyTokenFile holds the token of read-only kubeconfigs, which the proxy only accepts for read-only paths
+	proxyReadOnlyTokenFile = "read-only-token"
+	// maxProxyBodySize is the largest request body the proxy will read to evaluate manifests against profiles
+	maxProxyBodySize = 10 << 20
+)
+
+var (
+	// Used for flags.
+	proxyAddress    string
+	proxyPort       int
+	proxyKubeconfig string
+)
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.Flags().StringVar(&proxyAddress, "address", "127.0.0.1", "the address the proxy listens on")
+	proxyCmd.Flags().IntVar(&proxyPort, "port", 8443, "the port the proxy listens on")
+	proxyCmd.Flags().StringVar(&proxyKubeconfig, "kubeconfig-out", "", "where to write the kubeconfig that points at the proxy (default is $HOME/.kube/kube-lock-proxy.yaml)")
+}
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Run a local API server proxy that enforces kube-lock on every request to your clusters.",
+	Long: "Runs a local HTTPS reverse proxy in front of the contexts in your kubeconfig, and writes a kubeconfig that points at it.\n\n" +
+		"Any tool using that kubeconfig (helm, k9s, terraform, client-go scripts...) has every API request checked against the status of its context, just like 'kubectl-lock kubectl'. " +
+		"Requests are checked by what they do to the API rather than the command that sent them, e.g. 'kubectl apply' and 'kubectl label' are checked as 'patch' (or 'create'). " +
+		"Lock statuses and profiles are read on every request, so locking or unlocking a context takes effect straight away. " +
+		"Contexts kube-lock has no config entry for are refused.\n\n" +
+		"The proxy only serves clients with the token in the kubeconfig it writes, which changes every time it starts, so kubeconfigs from 'kubectl-lock kubeconfig' must be made again after a restart.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		err := runProxy()
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// kubeLockProxy routes requests for '/contexts/<context>/...' (or '/read-only/contexts/<context>/...') to the API server of the context
+type kubeLockProxy struct {
+	contexts map[string]*httputil.ReverseProxy
+	// token is what clients must send to use the proxy, as it makes requests with the user's own credentials
+	token string
+	// readOnlyToken is what read-only kubeconfigs send, which only gets them the read-only paths
+	readOnlyToken string
+	// config reads and profile evaluation aren't safe to run concurrently
+	mu sync.Mutex
+}
+
+func runProxy() error {
+	rawConfig, err := loadOriginalKubeconfig()
+	if err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := loadOrCreateProxyCert()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	token, err := newProxyToken()
+	if err != nil {
+		return err
+	}
+	readOnlyToken, err := newProxyToken()
+	if err != nil {
+		return err
+	}
+
+	p := &kubeLockProxy{contexts: map[string]*httputil.ReverseProxy{}, token: token, readOnlyToken: readOnlyToken}
+	for name := range rawConfig.Contexts {
+		if context != "" && name != context {
+			continue
+		}
+
+		restConfig, err := clientcmd.NewNonInteractiveClientConfig(*rawConfig, name, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			log.Warn("Skipping context '", name, "': ", err)
+			continue
+		}
+
+		reverseProxy, err := newContextReverseProxy(restConfig)
+		if err != nil {
+			log.Warn("Skipping context '", name, "': ", err)
+			continue
+		}
+		p.contexts[name] = reverseProxy
+		discoveryConfigs[name] = restConfig
+	}
+
+	if len(p.contexts) == 0 {
+		return errors.New("no contexts found to proxy in the kubeconfig")
+	}
+
+	err = writeProxyToken(proxyTokenFile, token)
+	if err != nil {
+		return err
+	}
+	err = writeProxyToken(proxyReadOnlyTokenFile, readOnlyToken)
+	if err != nil {
+		return err
+	}
+
+	address := net.JoinHostPort(proxyAddress, strconv.Itoa(proxyPort))
+	outPath, err := writeProxyKubeconfig(rawConfig, p.contexts, "https://"+address, certPEM, token)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Addr:      address,
+		Handler:   p,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+
+	log.Info("kube-lock proxy listening on https://", address, " for ", len(p.contexts), " context(s).")
+	log.Info("Point your tools at it with: export KUBECONFIG=", outPath)
+	return server.ListenAndServeTLS("", "")
+}
+
+func newContextReverseProxy(restConfig *rest.Config) (*httputil.ReverseProxy, error) {
+	host := restConfig.Host
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+
+	target, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := rest.TransportFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	director := reverseProxy.Director
+	reverseProxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = target.Host
+	}
+	reverseProxy.Transport = transport
+	// Watches and logs are streamed, so responses must be flushed straight away
+	reverseProxy.FlushInterval = -1
+
+	return reverseProxy, nil
+}
+
+func (p *kubeLockProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authenticated, readOnlyClient := p.authenticate(r)
+	if !authenticated {
+		writeProxyStatus(w, http.StatusUnauthorized, "Unauthorized", "KUBE-LOCK: the kube-lock proxy only serves clients with the token from the kubeconfig it wrote, which changes every time it starts")
+		return
+	}
+	// The context's own credentials are added by the transport, which leaves requests that already have some alone
+	r.Header.Del("Authorization")
+
+	kubeContext, path, readOnly, ok := splitProxyPath(r.URL.EscapedPath())
+	if !ok {
+		writeProxyStatus(w, http.StatusNotFound, "NotFound", "kube-lock proxy only serves paths under "+proxyContextPrefix+"<context>")
+		return
+	} else if readOnlyClient && !readOnly {
+		writeProxyStatus(w, http.StatusForbidden, "Forbidden", "KUBE-LOCK: Halt! The token of a read-only kubeconfig only gets read-only access to contexts.")
+		return
+	}
+
+	// Requests are sent on with the context's own credentials, so a client impersonating someone else would be
+	// acting with them as whoever it likes (even with the read-only token)
+	if impersonationHeadersSet(r.Header) {
+		writeProxyStatus(w, http.StatusForbidden, "Forbidden", "KUBE-LOCK: Halt! The kube-lock proxy doesn't let clients impersonate anyone (e.g. with kubectl's --as).")
+		return
+	}
+
+	reverseProxy, ok := p.contexts[kubeContext]
+	if !ok {
+		writeProxyStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("context '%s' is not proxied by kube-lock", kubeContext))
+		return
+	}
+
+	r.URL.RawPath = path
+	r.URL.Path, _ = url.PathUnescape(path)
+
+	var body []byte
+	if r.Body != nil && r.Method != http.MethodGet {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxProxyBodySize+1))
+		if err != nil {
+			writeProxyStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		} else if len(body) > maxProxyBodySize {
+			// Only part of it could be evaluated, so it can't be sent on
+			writeProxyStatus(w, http.StatusRequestEntityTooLarge, "RequestEntityTooLarge", fmt.Sprintf("KUBE-LOCK: the request body is larger than the %d bytes the kube-lock proxy can evaluate", maxProxyBodySize))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	decision, impersonate, err := p.evaluate(kubeContext, readOnly, r, body)
+	if err != nil {
+		log.Error("Context evaluation failed for '", kubeContext, "': ", err)
+		writeProxyStatus(w, http.StatusForbidden, "Forbidden", "KUBE-LOCK: context evaluation failed: "+err.Error())
+		return
+	}
+
+	if !decision.Allowed {
+		log.Info("Blocked ", r.Method, " ", r.URL.Path, " on context '", kubeContext, "': ", decision.Reason)
+		writeProxyStatus(w, http.StatusForbidden, "Forbidden", "KUBE-LOCK: Halt! "+decision.Reason)
+		return
+	}
+
+	if impersonate != nil {
+		applyImpersonation(r.Header, impersonate)
+	}
+
+	if decision.DryRun {
+		log.Info("Context '", kubeContext, "' is in dry-run mode, so ", r.Method, " ", r.URL.Path, " is a server-side dry-run: ", decision.Reason)
+		dryRunHTTP(r)
+	}
+
+	log.Debug("Allowed ", r.Method, " ", r.URL.Path, " on context '", kubeContext, "': ", decision.Reason)
+	reverseProxy.ServeHTTP(w, r)
+}
+
+// authenticate checks the request has one of the proxy's tokens, and returns whether it is the read-only one
+func (p *kubeLockProxy) authenticate(r *http.Request) (bool, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false, false
+	} else if subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) == 1 {
+		return true, false
+	}
+
+	readOnly := p.readOnlyToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.readOnlyToken)) == 1
+	return readOnly, readOnly
+}
+
+// evaluate checks the request against the current status of the context, reading the kube-lock config afresh
+// so changes made while the proxy is running are picked up. Read-only requests are only checked against the
+// built-in 'read-only' profile, so they can't be weakened by the config.
+func (p *kubeLockProxy) evaluate(kubeContext string, readOnly bool, r *http.Request, body []byte) (kubeLockDecision, *KubeLockImpersonate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := viper.ReadInConfig()
+	if err != nil {
+		return kubeLockDecision{}, nil, err
+	}
+
+	config, err := getViperConfig()
+	if err != nil {
+		return kubeLockDecision{}, nil, err
+	}
+	impersonate := findImpersonation(kubeContext, config)
+	// Resources are discovered from the context the request is for, with the same credentials it is sent with
+	currentDiscoveryTarget = discoveryTarget{Context: kubeContext}
+
+	req, resourceRequest := requestFromHTTP(r, kubeContext, body)
+	if !resourceRequest && r.Method == http.MethodGet {
+		return allow("Discovery and other non-resource reads are always allowed."), impersonate, nil
+	}
+
+	var decision kubeLockDecision
+	if readOnly {
+		decision, err = evaluateProfile(getReadOnlyProfile(), req)
+	} else {
+		decision, err = evaluateContextStatus(kubeContext, config, req)
+	}
+	if err != nil {
+		return kubeLockDecision{}, nil, err
+	}
+
+	// There is nobody to ask when a request comes through the proxy
+	if decision.Confirm {
+		return deny("%s The kube-lock proxy can't ask for confirmation, so use 'kubectl-lock kubectl' for this instead.", decision.Reason), nil, nil
+	}
+
+	return decision, impersonate, nil
+}
+
+// evaluateContextStatus decides whether a request is allowed by the status of the context, without changing the config
+func evaluateContextStatus(kubeContext string, config KubeLockConfig, req kubeLockRequest) (kubeLockDecision, error) {
+	status, unlockTimestamp, found := lookupContextStatus(kubeContext, config)
+	if !found {
+		return deny("No config entry exists for context '%s', so the kube-lock proxy refuses it. Add it with 'kubectl-lock set' (or by running 'kubectl-lock kubectl' against it).", kubeContext), nil
+	}
+
+	switch status {
+	case "unlocked":
+		if config.UnlockTimeoutPeriod != "" {
+			ok, err := checkIfUnlockExpired(unlockTimestamp, kubeContext, 0, config)
+			if err != nil {
+				return kubeLockDecision{}, err
+			} else if !ok {
+				return deny("Unlock for Context '%s' has expired (times out after %s).", kubeContext, config.UnlockTimeoutPeriod), nil
+			}
+		}
+		return allow("Context '%s' is unlocked!", kubeContext), nil
+	case "", "locked":
+		if impersonate := findImpersonation(kubeContext, config); impersonate != nil {
+			return allow("Context '%s' is locked, so requests impersonate '%s'.", kubeContext, impersonate), nil
+		}
+		return deny("Context '%s' is locked!", kubeContext), nil
+	}
+
+	profile, ok, err := validateProfileInConfig(status, config)
+	if err != nil {
+		return kubeLockDecision{}, err
+	} else if !ok {
+		return deny("Profile '%s' not found. Please add it, or change Profile for context '%s'.", status, kubeContext), nil
+	}
+
+	return evaluateProfile(profile, req)
+}
+
+// splitProxyPath splits '[/read-only]/contexts/<context>/<path>' into the (unescaped) context, the escaped path to
+// the API server, and whether the context is being accessed read-only
+func splitProxyPath(escapedPath string) (string, string, bool, bool) {
+	readOnly := strings.HasPrefix(escapedPath, proxyReadOnlyPrefix+proxyContextPrefix)
+	escapedPath = strings.TrimPrefix(escapedPath, proxyReadOnlyPrefix)
+	if !strings.HasPrefix(escapedPath, proxyContextPrefix) {
+		return "", "", false, false
+	}
+
+	escapedContext, path, _ := strings.Cut(strings.TrimPrefix(escapedPath, proxyContextPrefix), "/")
+	kubeContext, err := url.PathUnescape(escapedContext)
+	if err != nil || kubeContext == "" {
+		return "", "", false, false
+	}
+
+	return kubeContext, "/" + path, readOnly, true
+}
+
+// requestFromHTTP maps an API request onto the kubectl vocabulary that profiles are written in.
+// The bool returned is false for requests that don't address a resource (e.g. discovery and '/version').
+func requestFromHTTP(r *http.Request, kubeContext string, body []byte) (kubeLockRequest, bool) {
+	req := kubeLockRequest{Flags: map[string]string{}, Context: kubeContext}
+	req.Cluster, req.User, _ = findContextDetails(kubeContext, "")
+
+	// Resources in groups other than the core group are qualified with it, in kubectl's 'resource.version.group' form
+	var groupVersion string
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		groupVersion = "." + parts[2] + "." + parts[1]
+		parts = parts[3:]
+	default:
+		req.Verb = strings.ToLower(r.Method)
+		return req, false
+	}
+
+	// '/namespaces/<namespace>/status' and '/finalize' are subresources of the namespace, not resources within it
+	if len(parts) > 1 && parts[0] == "namespaces" {
+		req.Namespace = parts[1]
+		if len(parts) > 2 && parts[2] != "status" && parts[2] != "finalize" {
+			parts = parts[2:]
+		}
+	}
+
+	if len(parts) == 0 || parts[0] == "" {
+		req.Verb = strings.ToLower(r.Method)
+		return req, false
+	}
+
+	resource := parts[0] + groupVersion
+	req.Resources = []string{resource}
+	var subresource string
+	if len(parts) > 1 {
+		req.Names = []string{parts[1]}
+		req.Objects = map[string][]string{resource: req.Names}
+	}
+	if len(parts) > 2 {
+		subresource = parts[2]
+	}
+
+	query := r.URL.Query()
+	req.Verb = kubectlVerbForHTTP(r.Method, subresource)
+	for param, flag := range map[string]string{"labelSelector": "selector", "fieldSelector": "field-selector", "dryRun": "dry-run", "gracePeriodSeconds": "grace-period", "propagationPolicy": "cascade"} {
+		if value := query.Get(param); value != "" {
+			req.Flags[flag] = value
+		}
+	}
+	if query.Get("watch") == "true" || query.Get("watch") == "1" {
+		req.Flags["watch"] = "true"
+	}
+	if r.Method == http.MethodDelete && len(req.Names) == 0 {
+		req.Flags["all"] = "true"
+	}
+
+	if len(body) > 0 {
+		var object map[string]interface{}
+		if yaml.Unmarshal(body, &object) == nil && object != nil {
+			req.Manifests = []map[string]interface{}{object}
+		}
+
+		// The replicas scaled to are in the Scale (or the patch of it) rather than a flag
+		spec, _ := object["spec"].(map[string]interface{})
+		if replicas, ok := spec["replicas"]; ok && subresource == "scale" {
+			req.Flags["replicas"] = fmt.Sprint(replicas)
+		}
+	}
+
+	return req, true
+}
+
+// kubectlVerbForHTTP returns the kubectl verb that best describes an API request. It only goes by what the request
+// does to the API, never by what the client says about itself (e.g. its field manager), which it could make up.
+func kubectlVerbForHTTP(method string, subresource string) string {
+	switch subresource {
+	case "log":
+		return "logs"
+	case "exec", "attach", "proxy":
+		return subresource
+	case "portforward":
+		return "port-forward"
+	case "eviction":
+		return "drain"
+	case "scale":
+		if method != http.MethodGet {
+			return "scale"
+		}
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return "get"
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "replace"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	}
+
+	return strings.ToLower(method)
+}
+
+// writeProxyStatus responds with a Kubernetes Status, so clients like kubectl show the message to the user
+func writeProxyStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	status := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Reason:   reason,
+		Code:     int32(code),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+// lookupContextStatus finds the status of a context in the config without adding or changing anything
+func lookupContextStatus(kubeContext string, config KubeLockConfig) (string, string, bool) {
+	for _, c := range config.Contexts {
+		if c.Name == kubeContext {
+			return c.Status, c.UnlockTimestamp, true
+		}
+	}
+
+	return "", "", false
+}
+
+func getProxyDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".kube-lock", "proxy"), nil
+}
+
+// loadOrCreateProxyCert returns the serving certificate of the proxy, creating a new self-signed one if there isn't
+// a valid one on disk. It is kept on disk so the kubeconfigs that trust it stay valid between runs.
+func loadOrCreateProxyCert() ([]byte, []byte, error) {
+	dir, err := getProxyDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		block, _ := pem.Decode(certPEM)
+		if block != nil {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err == nil && time.Now().Before(cert.NotAfter.Add(-24*time.Hour)) && cert.VerifyHostname(proxyAddress) == nil {
+				return certPEM, keyPEM, nil
+			}
+		}
+		log.Info("Proxy certificate is invalid or about to expire, creating a new one...")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "kube-lock-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	if ip := net.ParseIP(proxyAddress); ip != nil && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if ip == nil && proxyAddress != "localhost" {
+		template.DNSNames = append(template.DNSNames, proxyAddress)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certPath, certPEM, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+// proxyServerForContext returns the URL a context is served on by the proxy
+func proxyServerForContext(server string, kubeContext string, readOnly bool) string {
+	if readOnly {
+		server += proxyReadOnlyPrefix
+	}
+
+	return server + proxyContextPrefix + url.PathEscape(kubeContext)
+}
+
+// writeProxyKubeconfig writes a kubeconfig with the same contexts as the original, all pointing at the proxy.
+// It holds no credentials for the clusters, as the proxy uses those of the original kubeconfig, only the proxy's token.
+func writeProxyKubeconfig(rawConfig *clientcmdapi.Config, contexts map[string]*httputil.ReverseProxy, server string, caPEM []byte, token string) (string, error) {
+	outPath := proxyKubeconfig
+	if outPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		outPath = filepath.Join(home, ".kube", "kube-lock-proxy.yaml")
+	}
+
+	out := clientcmdapi.NewConfig()
+	for name := range contexts {
+		addProxyContext(out, name, proxyServerForContext(server, name, false), rawConfig.Contexts[name].Namespace, caPEM, token)
+	}
+
+	if _, ok := contexts[rawConfig.CurrentContext]; ok {
+		out.CurrentContext = rawConfig.CurrentContext
+	}
+
+	err := os.MkdirAll(filepath.Dir(outPath), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return outPath, clientcmd.WriteToFile(*out, outPath)
+}
+
+// addProxyContext adds a context to the kubeconfig that points at the proxy. It holds no credentials for the cluster,
+// only the proxy's token.
+func addProxyContext(out *clientcmdapi.Config, kubeContext string, server string, namespace string, caPEM []byte, token string) {
+	authInfo := clientcmdapi.NewAuthInfo()
+	authInfo.Token = token
+	out.AuthInfos[proxyUserName] = authInfo
+
+	cluster := clientcmdapi.NewCluster()
+	cluster.Server = server
+	cluster.CertificateAuthorityData = caPEM
+	out.Clusters[kubeContext] = cluster
+
+	c := clientcmdapi.NewContext()
+	c.Cluster = kubeContext
+	c.AuthInfo = proxyUserName
+	c.Namespace = namespace
+	out.Contexts[kubeContext] = c
+}
+
+// newProxyToken makes a token for clients of the proxy to send
+func newProxyToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// writeProxyToken keeps a token of the running proxy where only the user can read it, so 'kubectl-lock kubeconfig'
+// can write kubeconfigs that use it
+func writeProxyToken(name string, token string) error {
+	dir, err := getProxyDir()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, name), []byte(token+"\n"), 0600)
+}
+
+// readProxyToken reads the token of the running proxy for a kubeconfig, which is the read-only one for a read-only
+// kubeconfig
+func readProxyToken(readOnly bool) (string, error) {
+	dir, err := getProxyDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := proxyTokenFile
+	if readOnly {
+		name = proxyReadOnlyTokenFile
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("the kube-lock proxy hasn't been started, so there is no token to use it with (start it with 'kubectl-lock proxy')")
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const testProxyConfig = `
+contexts:
+  - name: prod
+    status: restricted
+profiles:
+  - name: restricted
+    blockedVerbs: [create, delete]
+    deleteExceptions:
+      - group: apps
+        resource: deployments
+`
+
+// fakeAPIServer records the requests that reach it, and answers them with the response for their path, or an empty
+// list if there isn't one. A Status response is sent with its code, as the API server's errors are.
+type fakeAPIServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	requests  []*http.Request
+	responses map[string]string
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	t.Helper()
+
+	f := &fakeAPIServer{responses: map[string]string{}}
+	// TLS, as clientcmd only uses a context's credentials over it
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Clone(r.Context()))
+		response, ok := f.responses[r.URL.Path]
+		f.mu.Unlock()
+
+		if !ok {
+			response = `{"kind":"List","apiVersion":"v1","items":[]}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var status metav1.Status
+		if json.Unmarshal([]byte(response), &status) == nil && status.Kind == "Status" && status.Code != 0 {
+			w.WriteHeader(int(status.Code))
+		}
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+// respond sets what the server answers requests for the path with
+func (f *fakeAPIServer) respond(path string, response string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.responses[path] = response
+}
+
+// serveResource makes the server's discovery serve a namespaced resource in the group, as a CRD would be
+func (f *fakeAPIServer) serveResource(group string, version string, resource string, kind string) {
+	groupVersion := group + "/" + version
+	f.respond("/api", `{"kind":"APIVersions","versions":["v1"]}`)
+	f.respond("/api/v1", `{"kind":"APIResourceList","groupVersion":"v1","resources":[]}`)
+	f.respond("/apis", `{"kind":"APIGroupList","apiVersion":"v1","groups":[{"name":"`+group+`","versions":[{"groupVersion":"`+groupVersion+`","version":"`+version+`"}],"preferredVersion":{"groupVersion":"`+groupVersion+`","version":"`+version+`"}}]}`)
+	f.respond("/apis/"+groupVersion, `{"kind":"APIResourceList","apiVersion":"v1","groupVersion":"`+groupVersion+`","resources":[{"name":"`+resource+`","singularName":"","namespaced":true,"kind":"`+kind+`","verbs":["get","list","delete"]}]}`)
+}
+
+func (f *fakeAPIServer) lastRequest() *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// setupTestConfig writes a kubeconfig whose contexts point at the server, and the kube-lock config, and uses them in
+// place of the user's own
+func setupTestConfig(t *testing.T, server *httptest.Server, kubeLockConfig string, contexts ...string) *clientcmdapi.Config {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv(policyDirEnv, "")
+	t.Setenv(originalKubeconfigEnv, "")
+	os.Unsetenv(originalKubeconfigEnv)
+
+	kubeConfig := clientcmdapi.NewConfig()
+	kubeConfig.Clusters["test"] = &clientcmdapi.Cluster{Server: server.URL, CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})}
+	kubeConfig.AuthInfos["test"] = &clientcmdapi.AuthInfo{Token: "cluster-token"}
+	for _, name := range contexts {
+		kubeConfig.Contexts[name] = &clientcmdapi.Context{Cluster: "test", AuthInfo: "test"}
+	}
+	kubeConfig.CurrentContext = contexts[0]
+
+	kubeConfigPath := filepath.Join(dir, "kubeconfig")
+	if err := clientcmd.WriteToFile(*kubeConfig, kubeConfigPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", kubeConfigPath)
+
+	configPath := filepath.Join(dir, ".kube-lock.yaml")
+	if err := os.WriteFile(configPath, []byte(kubeLockConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Reset()
+	viper.SetConfigFile(configPath)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(viper.Reset)
+	discoveredResources = map[discoveryTarget]discoveredResourceList{}
+	discoveryConfigs = map[string]*rest.Config{}
+	currentDiscoveryTarget = discoveryTarget{}
+
+	return kubeConfig
+}
+
+// newTestProxy starts the proxy in front of the contexts of the kubeconfig
+func newTestProxy(t *testing.T, kubeConfig *clientcmdapi.Config, token string, readOnlyToken string) *httptest.Server {
+	t.Helper()
+
+	p := &kubeLockProxy{contexts: map[string]*httputil.ReverseProxy{}, token: token, readOnlyToken: readOnlyToken}
+	for name := range kubeConfig.Contexts {
+		restConfig, err := clientcmd.NewNonInteractiveClientConfig(*kubeConfig, name, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p.contexts[name], err = newContextReverseProxy(restConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		discoveryConfigs[name] = restConfig
+	}
+
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProxy(t *testing.T) {
+	api := newFakeAPIServer(t)
+	kubeConfig := setupTestConfig(t, api.Server, testProxyConfig, "prod", "unconfigured")
+	proxy := newTestProxy(t, kubeConfig, "proxy-token", "read-only-token")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		header http.Header
+		body   string
+		code   int
+	}{
+		{name: "no token", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", code: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "guess", code: http.StatusUnauthorized},
+		{name: "get is allowed", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "proxy-token", code: http.StatusOK},
+		{name: "discovery is allowed", method: http.MethodGet, path: "/contexts/prod/apis", token: "proxy-token", code: http.StatusOK},
+		{name: "blocked delete", method: http.MethodDelete, path: "/contexts/prod/api/v1/namespaces/default/pods/foo", token: "proxy-token", code: http.StatusForbidden},
+		{name: "delete exception by group", method: http.MethodDelete, path: "/contexts/prod/apis/apps/v1/namespaces/default/deployments/foo", token: "proxy-token", code: http.StatusOK},
+		{name: "delete exception is for another group", method: http.MethodDelete, path: "/contexts/prod/apis/batch/v1/namespaces/default/jobs/foo", token: "proxy-token", code: http.StatusForbidden},
+		{name: "field manager can't change the verb", method: http.MethodPost, path: "/contexts/prod/api/v1/namespaces/default/pods?fieldManager=kubectl-get", token: "proxy-token", body: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"foo"}}`, code: http.StatusForbidden},
+		{name: "unconfigured context is refused", method: http.MethodGet, path: "/contexts/unconfigured/api/v1/namespaces/default/pods", token: "proxy-token", code: http.StatusForbidden},
+		{name: "unknown context", method: http.MethodGet, path: "/contexts/missing/api/v1/pods", token: "proxy-token", code: http.StatusNotFound},
+		{name: "read-only token can read", method: http.MethodGet, path: "/read-only/contexts/prod/api/v1/namespaces/default/pods", token: "read-only-token", code: http.StatusOK},
+		{name: "read-only token can't write", method: http.MethodDelete, path: "/read-only/contexts/prod/apis/apps/v1/namespaces/default/deployments/foo", token: "read-only-token", code: http.StatusForbidden},
+		{name: "read-only token can't leave read-only paths", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "read-only-token", code: http.StatusForbidden},
+		{name: "client can't impersonate", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "proxy-token", header: http.Header{"Impersonate-User": {"admin"}}, code: http.StatusForbidden},
+		{name: "client can't impersonate a group", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "proxy-token", header: http.Header{"Impersonate-Group": {"system:masters"}}, code: http.StatusForbidden},
+		{name: "client can't impersonate extra", method: http.MethodGet, path: "/contexts/prod/api/v1/namespaces/default/pods", token: "proxy-token", header: http.Header{"impersonate-extra-scopes": {"admin"}}, code: http.StatusForbidden},
+		{name: "read-only token can't impersonate", method: http.MethodGet, path: "/read-only/contexts/prod/api/v1/namespaces/default/pods", token: "read-only-token", header: http.Header{"Impersonate-User": {"admin"}}, code: http.StatusForbidden},
+		{name: "body too large", method: http.MethodPatch, path: "/contexts/prod/api/v1/namespaces/default/configmaps/foo", token: "proxy-token", body: strings.Repeat("a", maxProxyBodySize+1), code: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := api.lastRequest()
+
+			r, err := http.NewRequest(tt.method, proxy.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.code {
+				t.Fatalf("got status %d, want %d: %s", resp.StatusCode, tt.code, body)
+			}
+
+			reached := api.lastRequest()
+			if tt.code != http.StatusOK {
+				if reached != before {
+					t.Fatalf("request reached the API server: %s %s", reached.Method, reached.URL)
+				}
+				return
+			}
+
+			if reached == before {
+				t.Fatal("request didn't reach the API server")
+			}
+			// The proxy's token is swapped for the context's own credentials
+			if got := reached.Header.Get("Authorization"); got != "Bearer cluster-token" {
+				t.Fatalf("API server got Authorization %q, want the context's token", got)
+			}
+			if impersonationHeadersSet(reached.Header) {
+				t.Fatalf("API server got impersonation headers %v", reached.Header)
+			}
+		})
+	}
+}
+
+func TestKubectlVerbForHTTP(t *testing.T) {
+	tests := []struct {
+		method      string
+		subresource string
+		want        string
+	}{
+		{method: http.MethodGet, want: "get"},
+		{method: http.MethodPost, want: "create"},
+		{method: http.MethodPut, want: "replace"},
+		{method: http.MethodPatch, want: "patch"},
+		{method: http.MethodDelete, want: "delete"},
+		{method: http.MethodGet, subresource: "log", want: "logs"},
+		{method: http.MethodPost, subresource: "eviction", want: "drain"},
+		{method: http.MethodPatch, subresource: "scale", want: "scale"},
+		{method: http.MethodGet, subresource: "scale", want: "get"},
+	}
+
+	for _, tt := range tests {
+		if got := kubectlVerbForHTTP(tt.method, tt.subresource); got != tt.want {
+			t.Errorf("kubectlVerbForHTTP(%s, %q) = %q, want %q", tt.method, tt.subresource, got, tt.want)
+		}
+	}
+}
+
+func TestRequestFromHTTPGroup(t *testing.T) {
+	setupTestConfig(t, newFakeAPIServer(t).Server, testProxyConfig, "prod")
+
+	r := httptest.NewRequest(http.MethodDelete, "/apis/apps/v1/namespaces/default/deployments/foo", nil)
+	req, ok := requestFromHTTP(r, "prod", nil)
+	if !ok {
+		t.Fatal("request wasn't recognised as a resource request")
+	}
+
+	if len(req.Resources) != 1 || req.Resources[0] != "deployments.v1.apps" {
+		t.Fatalf("got resources %v, want [deployments.v1.apps]", req.Resources)
+	}
+	if req.Namespace != "default" || len(req.Names) != 1 || req.Names[0] != "foo" {
+		t.Fatalf("got namespace %q and names %v", req.Namespace, req.Names)
+	}
+}
+
+const testProxyDiscoveryConfig = `
+contexts:
+  - name: a
+    status: restricted
+  - name: b
+    status: restricted
+profiles:
+  - name: restricted
+    blockedVerbs: [delete]
+    deleteExceptions:
+      - group: a.example.com
+        resource: widgets
+`
+
+func TestProxyDiscoversEachContext(t *testing.T) {
+	apiA, apiB := newFakeAPIServer(t), newFakeAPIServer(t)
+	apiA.serveResource("a.example.com", "v1", "widgets", "Widget")
+	apiB.serveResource("b.example.com", "v1", "gadgets", "Gadget")
+
+	// Context 'a' is the current context, which every context's resources used to be discovered from
+	kubeConfig := setupTestConfig(t, apiA.Server, testProxyDiscoveryConfig, "a", "b")
+	kubeConfig.Clusters["b"] = &clientcmdapi.Cluster{Server: apiB.URL, CertificateAuthorityData: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: apiB.Certificate().Raw})}
+	kubeConfig.Contexts["b"].Cluster = "b"
+	if err := clientcmd.WriteToFile(*kubeConfig, os.Getenv("KUBECONFIG")); err != nil {
+		t.Fatal(err)
+	}
+	proxy := newTestProxy(t, kubeConfig, "proxy-token", "")
+
+	tests := []struct {
+		name string
+		path string
+		code int
+	}{
+		{name: "exception for a CRD the context serves", path: "/contexts/a/apis/a.example.com/v1/namespaces/default/widgets/foo", code: http.StatusOK},
+		{name: "the other context doesn't serve it", path: "/contexts/b/apis/a.example.com/v1/namespaces/default/widgets/foo", code: http.StatusForbidden},
+		{name: "no exception for the other context's CRD", path: "/contexts/b/apis/b.example.com/v1/namespaces/default/gadgets/foo", code: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyRequest(t, proxy, http.MethodDelete, tt.path, "proxy-token", ""); got != tt.code {
+				t.Fatalf("got status %d, want %d", got, tt.code)
+			}
+		})
+	}
+
+	if len(discoveredResources) != 2 {
+		t.Fatalf("got resources discovered for %d contexts, want each context's own", len(discoveredResources))
+	}
+}
+
+// proxyRequest sends a request through the proxy, and returns its status
+func proxyRequest(t *testing.T, proxy *httptest.Server, method string, path string, token string, body string) int {
+	t.Helper()
+
+	r, err := http.NewRequest(method, proxy.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+const testProxyPreflightConfig = `
+contexts:
+  - name: prod
+    status: counted
+profiles:
+  - name: counted
+    blockedVerbs: []
+    preflightRules:
+      - verbs: [scale]
+        group: ""
+        resource: pods
+        threshold: 2
+      - verbs: [drain]
+        group: ""
+        resource: pods
+        threshold: 0
+`
+
+func TestProxyPreflight(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.respond("/apis/apps/v1/namespaces/default/deployments/web", `{"kind":"Deployment","apiVersion":"apps/v1","metadata":{"name":"web"},"spec":{"replicas":5}}`)
+	kubeConfig := setupTestConfig(t, api.Server, testProxyPreflightConfig, "prod")
+	proxy := newTestProxy(t, kubeConfig, "proxy-token", "")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "an eviction is of one pod", method: http.MethodPost, path: "/contexts/prod/api/v1/namespaces/default/pods/a/eviction", body: `{"apiVersion":"policy/v1","kind":"Eviction","metadata":{"name":"a"}}`, code: http.StatusForbidden},
+		{name: "scaling to zero counts the pods removed", method: http.MethodPatch, path: "/contexts/prod/apis/apps/v1/namespaces/default/deployments/web/scale", body: `{"spec":{"replicas":0}}`, code: http.StatusForbidden},
+		{name: "scaling down a little", method: http.MethodPatch, path: "/contexts/prod/apis/apps/v1/namespaces/default/deployments/web/scale", body: `{"spec":{"replicas":4}}`, code: http.StatusOK},
+		{name: "replacing the scale", method: http.MethodPut, path: "/contexts/prod/apis/apps/v1/namespaces/default/deployments/web/scale", body: `{"apiVersion":"autoscaling/v1","kind":"Scale","metadata":{"name":"web"},"spec":{"replicas":6}}`, code: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyRequest(t, proxy, tt.method, tt.path, "proxy-token", tt.body); got != tt.code {
+				t.Fatalf("got status %d, want %d", got, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// kubeLockRequest is the structured form of a command that profiles are evaluated against
+type kubeLockRequest struct {
+	Verb      string
+	SubVerb   string
+	Resources []string
+	Names     []string
+	Objects   map[string][]string
+	Namespace string
+	Flags     map[string]string
+	Context   string
+	Cluster   string
+	User      string
+	Manifests []map[string]interface{}
+	// UnreadManifests are the manifests kube-lock can't read itself (stdin, URLs and kustomizations), so it doesn't
+	// know which objects they have
+	UnreadManifests []string
+}
+
+// getShortFlagNames maps the kubectl shorthand flags to their long names
+func getShortFlagNames() map[string]string {
+	return map[string]string{
+		"A": "all-namespaces",
+		"R": "recursive",
+		"c": "container",
+		"f": "filename",
+		"i": "stdin",
+		"k": "kustomize",
+		"l": "selector",
+		"n": "namespace",
+		"o": "output",
+		"p": "patch",
+		"t": "tty",
+		"w": "watch",
+	}
+}
+
+// getSubVerbCommands returns the verbs whose first argument is a subcommand rather than a resource
+func getSubVerbCommands() []string {
+	return []string{"adm", "apply", "auth", "certificate", "config", "create", "image", "plugin", "policy", "registry", "rollout", "secrets", "set", "top"}
+}
+
+// getOCAdmVerbs returns the 'oc adm' subcommands that do the same as the kubectl verb of the same name, so
+// 'oc adm drain' is evaluated as 'drain'
+func getOCAdmVerbs() []string {
+	return []string{"certificate", "cordon", "drain", "taint", "top", "uncordon"}
+}
+
+// Manipulated from https://github.com/spf13/cobra/blob/bfacc59f62c67ffd43e93655a8d933cefab0fa99/command.go#L685 to find the flags and skip them
+func parseKubectlRequest(args []string, kubeContext string) (kubeLockRequest, error) {
+	req := kubeLockRequest{Context: kubeContext}
+
+	var positional []string
+	req.Flags, positional = parseArgs(args, getBoolFlags(), getShortFlagNames())
+	if len(positional) > 0 {
+		// Flags before the verb are kubectl's global flags, which mean the same whatever the verb, so the verb found
+		// the first time is the one to parse its own flags for
+		if boolFlags, shortFlags, ok := getVerbFlags(positional[0]); ok {
+			req.Flags, positional = parseArgs(args, boolFlags, shortFlags)
+		}
+	}
+
+	if len(positional) > 0 {
+		req.Verb = positional[0]
+		positional = positional[1:]
+	}
+	if req.Verb == "adm" && len(positional) > 0 && contains(getOCAdmVerbs(), positional[0]) {
+		req.Verb = positional[0]
+		positional = positional[1:]
+	}
+	if contains(getSubVerbCommands(), req.Verb) && len(positional) > 0 {
+		req.SubVerb = positional[0]
+		positional = positional[1:]
+	}
+	req.Resources, req.Names, req.Objects = splitResourceArgs(req.Verb, positional)
+	req.Namespace = req.Flags["namespace"]
+
+	var err error
+	req.Cluster, req.User, err = findContextDetails(kubeContext, req.Flags["kubeconfig"])
+	if err != nil {
+		log.Debug("Unable to find the cluster and user for context '", kubeContext, "': ", err)
+	}
+
+	if filenames, ok := req.Flags["filename"]; ok {
+		req.Manifests, req.UnreadManifests, err = readManifests(strings.Split(filenames, ","), flagSet(req.Flags, "--recursive"))
+		if err != nil {
+			return req, err
+		}
+	}
+	// kustomize builds the objects, so only kubectl knows what they are
+	if kustomizations, ok := req.Flags["kustomize"]; ok {
+		req.UnreadManifests = append(req.UnreadManifests, strings.Split(kustomizations, ",")...)
+	}
+
+	return req, nil
+}
+
+// parseArgs splits the arguments of a command into its flags (keyed by long name) and its positional arguments.
+// Flags not in boolFlags are assumed to take a value, unless they are followed by another flag.
+func parseArgs(args []string, boolFlags []string, shortFlags map[string]string) (map[string]string, []string) {
+	flags := map[string]string{}
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		// Everything after '--' belongs to the command being run in the container (e.g. 'kubectl exec')
+		case arg == "--":
+			i = len(args)
+		// A long flag with a '=' separator
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "="):
+			name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+			addFlag(flags, name, value)
+		// A long flag that is either a bool or has a space separated value
+		case strings.HasPrefix(arg, "--"):
+			if contains(boolFlags, arg) || i+1 >= len(args) || looksLikeFlag(args[i+1]) {
+				addFlag(flags, strings.TrimPrefix(arg, "--"), "true")
+				continue
+			}
+			addFlag(flags, strings.TrimPrefix(arg, "--"), args[i+1])
+			i++
+		// A short flag (or a group of short bool flags such as '-it')
+		case looksLikeFlag(arg):
+			short := strings.TrimPrefix(arg, "-")
+			name := string(short[0])
+			if long, ok := shortFlags[name]; ok {
+				name = long
+			}
+			switch {
+			case len(short) > 1 && isShortBoolGroup(short, boolFlags):
+				for _, c := range short {
+					n := string(c)
+					if long, ok := shortFlags[n]; ok {
+						n = long
+					}
+					addFlag(flags, n, "true")
+				}
+			case len(short) > 1:
+				addFlag(flags, name, strings.TrimPrefix(short[1:], "="))
+			case contains(boolFlags, arg) || i+1 >= len(args) || looksLikeFlag(args[i+1]):
+				addFlag(flags, name, "true")
+			default:
+				addFlag(flags, name, args[i+1])
+				i++
+			}
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	return flags, positional
+}
+
+// addFlag records a flag, joining repeated flags (e.g. '-f a.yaml -f b.yaml') with commas like kubectl does
+func addFlag(flags map[string]string, name string, value string) {
+	if existing, ok := flags[name]; ok && existing != "true" {
+		flags[name] = existing + "," + value
+		return
+	}
+	flags[name] = value
+}
+
+// looksLikeFlag checks if an argument is a flag rather than the value of the flag before it ('-' alone is stdin)
+func looksLikeFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-") && len(arg) > 1
+}
+
+func isShortBoolGroup(short string, boolFlags []string) bool {
+	for _, c := range short {
+		if !contains(boolFlags, "-"+string(c)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitResourceArgs separates the resource types from the object names in the arguments of a command, and returns
+// the names of the objects of each type
+func splitResourceArgs(verb string, args []string) ([]string, []string, map[string][]string) {
+	var resources []string
+	var names []string
+	var listed []string
+	objects := map[string][]string{}
+
+	for i, arg := range args {
+		// label, annotate and taint take 'key=value' and 'key-' arguments after the names
+		if (verb == "label" || verb == "annotate" || verb == "taint") && (strings.Contains(arg, "=") || strings.HasSuffix(arg, "-")) {
+			continue
+		}
+
+		if resource, name, ok := splitResourceArg(arg); ok {
+			resources = appendUniqueStrings(resources, resource)
+			names = append(names, name)
+			objects[resource] = append(objects[resource], name)
+		} else if i == 0 && contains(getResourceVerbs(), verb) {
+			// 'pods,svc' addresses both types
+			listed = strings.Split(arg, ",")
+			resources = appendUniqueStrings(resources, listed...)
+		} else {
+			names = append(names, arg)
+			for _, resource := range listed {
+				objects[resource] = append(objects[resource], arg)
+			}
+		}
+	}
+
+	return resources, names, objects
+}
+
+// findContextDetails returns the cluster and user that a context refers to in the kubeconfig, or in the one kubectl
+// uses by default if it is empty
+func findContextDetails(kubeContext string, kubeconfig string) (string, string, error) {
+	kubeConfig, err := kubeconfigLoadingRules(kubeconfig).Load()
+	if err != nil {
+		return "", "", err
+	}
+
+	c, ok := kubeConfig.Contexts[kubeContext]
+	if !ok {
+		return "", "", errors.New("context not found in kubeconfig")
+	}
+
+	return c.Cluster, c.AuthInfo, nil
+}
+
+// readManifests decodes the objects from the files (or directories, and their subdirectories if recursive) passed
+// with '-f'. Stdin and URLs are left for kubectl to read, and are returned as unread.
+func readManifests(filenames []string, recursive bool) ([]map[string]interface{}, []string, error) {
+	var manifests []map[string]interface{}
+	var unread []string
+	for _, filename := range filenames {
+		if filename == "-" || strings.Contains(filename, "://") {
+			unread = append(unread, filename)
+			continue
+		}
+
+		files, err := findManifestFiles(filename, recursive)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, file := range files {
+			objects, err := decodeManifestFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			manifests = append(manifests, objects...)
+		}
+	}
+
+	return manifests, unread, nil
+}
+
+// findManifestFiles returns the file, or the manifests in the directory (and its subdirectories if recursive) that
+// kubectl would read
+func findManifestFiles(filename string, recursive bool) ([]string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return []string{filename}, nil
+	}
+
+	var files []string
+	err = filepath.WalkDir(filename, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() && path != filename && !recursive {
+			return filepath.SkipDir
+		} else if !d.IsDir() && contains([]string{".yaml", ".yml", ".json"}, filepath.Ext(path)) {
+			files = append(files, path)
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+func decodeManifestFile(file string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeManifests(data)
+}
+
+// decodeManifests decodes the objects from a multi-document YAML (or JSON) stream
+func decodeManifests(data []byte) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var object map[string]interface{}
+		err := decoder.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if object == nil {
+			continue
+		}
+
+		// Lists are flattened so that every object is evaluated on its own
+		if items, ok := object["items"].([]interface{}); ok && strings.HasSuffix(toString(object["kind"]), "List") {
+			for _, item := range items {
+				if m, ok := item.(map[string]interface{}); ok {
+					objects = append(objects, m)
+				}
+			}
+			continue
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+func toString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
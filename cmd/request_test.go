@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseKubectlRequest(t *testing.T) {
+	setupTestConfig(t, newFakeAPIServer(t).Server, testProxyConfig, "prod")
+
+	manifest := filepath.Join(t.TempDir(), "web.yaml")
+	err := os.WriteFile(manifest, []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: web\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		args      []string
+		verb      string
+		subVerb   string
+		resources []string
+		names     []string
+		objects   map[string][]string
+		namespace string
+		manifests int
+		unread    []string
+	}{
+		{name: "resource and name", args: []string{"delete", "pod", "foo", "-n", "prod"}, verb: "delete", resources: []string{"pod"}, names: []string{"foo"}, objects: map[string][]string{"pod": {"foo"}}, namespace: "prod"},
+		{name: "global flags before the verb", args: []string{"--namespace=prod", "get", "pods"}, verb: "get", resources: []string{"pods"}, objects: map[string][]string{}, namespace: "prod"},
+		{name: "type/name", args: []string{"delete", "deploy/web", "svc/web"}, verb: "delete", resources: []string{"deploy", "svc"}, names: []string{"web", "web"}, objects: map[string][]string{"deploy": {"web"}, "svc": {"web"}}},
+		{name: "comma separated types", args: []string{"get", "pods,svc", "web"}, verb: "get", resources: []string{"pods", "svc"}, names: []string{"web"}, objects: map[string][]string{"pods": {"web"}, "svc": {"web"}}},
+		{name: "group-qualified type", args: []string{"delete", "deployments.v1.apps", "web"}, verb: "delete", resources: []string{"deployments.v1.apps"}, names: []string{"web"}, objects: map[string][]string{"deployments.v1.apps": {"web"}}},
+		{name: "group/version-qualified type/name", args: []string{"delete", "deployment.apps/v1/web"}, verb: "delete", resources: []string{"deployment.apps/v1"}, names: []string{"web"}, objects: map[string][]string{"deployment.apps/v1": {"web"}}},
+		{name: "sub-verb", args: []string{"rollout", "restart", "deploy/web"}, verb: "rollout", subVerb: "restart", resources: []string{"deploy"}, names: []string{"web"}, objects: map[string][]string{"deploy": {"web"}}},
+		{name: "oc adm verb", args: []string{"adm", "drain", "node-1"}, verb: "drain", names: []string{"node-1"}, objects: map[string][]string{}},
+		{name: "label arguments aren't names", args: []string{"label", "pods", "foo", "tier=web", "old-"}, verb: "label", resources: []string{"pods"}, names: []string{"foo"}, objects: map[string][]string{"pods": {"foo"}}},
+		{name: "command run in the container", args: []string{"exec", "foo", "--", "rm", "-rf", "/"}, verb: "exec", names: []string{"foo"}, objects: map[string][]string{}},
+		{name: "logs flags", args: []string{"logs", "-f", "foo"}, verb: "logs", names: []string{"foo"}, objects: map[string][]string{}},
+		{name: "manifests", args: []string{"apply", "-f", manifest}, verb: "apply", objects: map[string][]string{}, manifests: 2},
+		{name: "manifests kube-lock can't read", args: []string{"apply", "-f", "-", "-k", "overlays/prod"}, verb: "apply", objects: map[string][]string{}, unread: []string{"-", "overlays/prod"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := parseKubectlRequest(tt.args, "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Verb != tt.verb || req.SubVerb != tt.subVerb || req.Namespace != tt.namespace {
+				t.Errorf("got verb %q, sub-verb %q and namespace %q, want %q, %q and %q", req.Verb, req.SubVerb, req.Namespace, tt.verb, tt.subVerb, tt.namespace)
+			}
+			if !reflect.DeepEqual(req.Resources, tt.resources) || !reflect.DeepEqual(req.Names, tt.names) || !reflect.DeepEqual(req.Objects, tt.objects) {
+				t.Errorf("got resources %v, names %v and objects %v, want %v, %v and %v", req.Resources, req.Names, req.Objects, tt.resources, tt.names, tt.objects)
+			}
+			if len(req.Manifests) != tt.manifests || !reflect.DeepEqual(req.UnreadManifests, tt.unread) {
+				t.Errorf("got %d manifests and unread %v, want %d and %v", len(req.Manifests), req.UnreadManifests, tt.manifests, tt.unread)
+			}
+			if req.Context != "prod" || req.Cluster != "test" || req.User != "test" {
+				t.Errorf("got context %q, cluster %q and user %q, want those of 'prod' in the kubeconfig", req.Context, req.Cluster, req.User)
+			}
+		})
+	}
+}
@@ -0,0 +1,424 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+)
+
+// kubeLockResource is a resource type, as listed by 'kubectl api-resources'
+type kubeLockResource struct {
+	Name          string
+	SingularName  string
+	ShortNames    []string
+	Kind          string
+	Group         string
+	Versions      []string
+	ClusterScoped bool
+}
+
+// versionPattern matches API versions, e.g. 'v1', 'v2beta1'
+var versionPattern = regexp.MustCompile(`^v[0-9]+((alpha|beta)[0-9]+)?$`)
+
+// discoveryTarget is the context resources are discovered from, and the kubeconfig it is in. Empty ones mean the
+// kubeconfig kubectl uses by default, and its current context.
+type discoveryTarget struct {
+	Context    string
+	Kubeconfig string
+}
+
+// discoveredResourceList is the resources discovered from a context, and when
+type discoveredResourceList struct {
+	Resources  []kubeLockResource
+	Discovered time.Time
+}
+
+var (
+	// currentDiscoveryTarget is the context the command (or proxied request) being evaluated addresses, so its
+	// resources are discovered from the right cluster
+	currentDiscoveryTarget discoveryTarget
+	// discoveryConfigs are the client configs of contexts known up front (the proxy's), which are used to discover
+	// their resources in place of loading the kubeconfig
+	discoveryConfigs = map[string]*rest.Config{}
+	// discoveredResources holds the resources found with discovery for each context, so a cluster is only asked once
+	// per command, or once in the discovery cache's lifetime for the proxy
+	discoveredResources = map[discoveryTarget]discoveredResourceList{}
+)
+
+// getResourceCatalogue returns the resources built into kube-lock, so the common ones resolve without the cluster.
+// The core group comes first, so short names shared with another group (e.g. 'ev') resolve to it, as in kubectl.
+func getResourceCatalogue() []kubeLockResource {
+	return []kubeLockResource{
+		{Name: "bindings", SingularName: "binding", Kind: "Binding", Versions: []string{"v1"}},
+		{Name: "componentstatuses", SingularName: "componentstatus", ShortNames: []string{"cs"}, Kind: "ComponentStatus", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "configmaps", SingularName: "configmap", ShortNames: []string{"cm"}, Kind: "ConfigMap", Versions: []string{"v1"}},
+		{Name: "endpoints", SingularName: "endpoints", ShortNames: []string{"ep"}, Kind: "Endpoints", Versions: []string{"v1"}},
+		{Name: "events", SingularName: "event", ShortNames: []string{"ev"}, Kind: "Event", Versions: []string{"v1"}},
+		{Name: "limitranges", SingularName: "limitrange", ShortNames: []string{"limits"}, Kind: "LimitRange", Versions: []string{"v1"}},
+		{Name: "namespaces", SingularName: "namespace", ShortNames: []string{"ns"}, Kind: "Namespace", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "nodes", SingularName: "node", ShortNames: []string{"no"}, Kind: "Node", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "persistentvolumeclaims", SingularName: "persistentvolumeclaim", ShortNames: []string{"pvc"}, Kind: "PersistentVolumeClaim", Versions: []string{"v1"}},
+		{Name: "persistentvolumes", SingularName: "persistentvolume", ShortNames: []string{"pv"}, Kind: "PersistentVolume", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "pods", SingularName: "pod", ShortNames: []string{"po"}, Kind: "Pod", Versions: []string{"v1"}},
+		{Name: "podtemplates", SingularName: "podtemplate", Kind: "PodTemplate", Versions: []string{"v1"}},
+		{Name: "replicationcontrollers", SingularName: "replicationcontroller", ShortNames: []string{"rc"}, Kind: "ReplicationController", Versions: []string{"v1"}},
+		{Name: "resourcequotas", SingularName: "resourcequota", ShortNames: []string{"quota"}, Kind: "ResourceQuota", Versions: []string{"v1"}},
+		{Name: "secrets", SingularName: "secret", Kind: "Secret", Versions: []string{"v1"}},
+		{Name: "serviceaccounts", SingularName: "serviceaccount", ShortNames: []string{"sa"}, Kind: "ServiceAccount", Versions: []string{"v1"}},
+		{Name: "services", SingularName: "service", ShortNames: []string{"svc"}, Kind: "Service", Versions: []string{"v1"}},
+		{Name: "mutatingwebhookconfigurations", SingularName: "mutatingwebhookconfiguration", Kind: "MutatingWebhookConfiguration", Group: "admissionregistration.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "validatingwebhookconfigurations", SingularName: "validatingwebhookconfiguration", Kind: "ValidatingWebhookConfiguration", Group: "admissionregistration.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "validatingadmissionpolicies", SingularName: "validatingadmissionpolicy", Kind: "ValidatingAdmissionPolicy", Group: "admissionregistration.k8s.io", Versions: []string{"v1", "v1beta1"}, ClusterScoped: true},
+		{Name: "validatingadmissionpolicybindings", SingularName: "validatingadmissionpolicybinding", Kind: "ValidatingAdmissionPolicyBinding", Group: "admissionregistration.k8s.io", Versions: []string{"v1", "v1beta1"}, ClusterScoped: true},
+		{Name: "customresourcedefinitions", SingularName: "customresourcedefinition", ShortNames: []string{"crd", "crds"}, Kind: "CustomResourceDefinition", Group: "apiextensions.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "apiservices", SingularName: "apiservice", Kind: "APIService", Group: "apiregistration.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "controllerrevisions", SingularName: "controllerrevision", Kind: "ControllerRevision", Group: "apps", Versions: []string{"v1"}},
+		{Name: "daemonsets", SingularName: "daemonset", ShortNames: []string{"ds"}, Kind: "DaemonSet", Group: "apps", Versions: []string{"v1"}},
+		{Name: "deployments", SingularName: "deployment", ShortNames: []string{"deploy"}, Kind: "Deployment", Group: "apps", Versions: []string{"v1"}},
+		{Name: "replicasets", SingularName: "replicaset", ShortNames: []string{"rs"}, Kind: "ReplicaSet", Group: "apps", Versions: []string{"v1"}},
+		{Name: "statefulsets", SingularName: "statefulset", ShortNames: []string{"sts"}, Kind: "StatefulSet", Group: "apps", Versions: []string{"v1"}},
+		{Name: "selfsubjectreviews", SingularName: "selfsubjectreview", Kind: "SelfSubjectReview", Group: "authentication.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "tokenreviews", SingularName: "tokenreview", Kind: "TokenReview", Group: "authentication.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "localsubjectaccessreviews", SingularName: "localsubjectaccessreview", Kind: "LocalSubjectAccessReview", Group: "authorization.k8s.io", Versions: []string{"v1"}},
+		{Name: "selfsubjectaccessreviews", SingularName: "selfsubjectaccessreview", Kind: "SelfSubjectAccessReview", Group: "authorization.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "selfsubjectrulesreviews", SingularName: "selfsubjectrulesreview", Kind: "SelfSubjectRulesReview", Group: "authorization.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "subjectaccessreviews", SingularName: "subjectaccessreview", Kind: "SubjectAccessReview", Group: "authorization.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "horizontalpodautoscalers", SingularName: "horizontalpodautoscaler", ShortNames: []string{"hpa"}, Kind: "HorizontalPodAutoscaler", Group: "autoscaling", Versions: []string{"v2", "v1"}},
+		{Name: "cronjobs", SingularName: "cronjob", ShortNames: []string{"cj"}, Kind: "CronJob", Group: "batch", Versions: []string{"v1"}},
+		{Name: "jobs", SingularName: "job", Kind: "Job", Group: "batch", Versions: []string{"v1"}},
+		{Name: "certificatesigningrequests", SingularName: "certificatesigningrequest", ShortNames: []string{"csr"}, Kind: "CertificateSigningRequest", Group: "certificates.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "leases", SingularName: "lease", Kind: "Lease", Group: "coordination.k8s.io", Versions: []string{"v1"}},
+		{Name: "endpointslices", SingularName: "endpointslice", Kind: "EndpointSlice", Group: "discovery.k8s.io", Versions: []string{"v1"}},
+		{Name: "events", SingularName: "event", ShortNames: []string{"ev"}, Kind: "Event", Group: "events.k8s.io", Versions: []string{"v1"}},
+		{Name: "flowschemas", SingularName: "flowschema", Kind: "FlowSchema", Group: "flowcontrol.apiserver.k8s.io", Versions: []string{"v1", "v1beta3"}, ClusterScoped: true},
+		{Name: "prioritylevelconfigurations", SingularName: "prioritylevelconfiguration", Kind: "PriorityLevelConfiguration", Group: "flowcontrol.apiserver.k8s.io", Versions: []string{"v1", "v1beta3"}, ClusterScoped: true},
+		{Name: "ingressclasses", SingularName: "ingressclass", Kind: "IngressClass", Group: "networking.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "ingresses", SingularName: "ingress", ShortNames: []string{"ing"}, Kind: "Ingress", Group: "networking.k8s.io", Versions: []string{"v1"}},
+		{Name: "networkpolicies", SingularName: "networkpolicy", ShortNames: []string{"netpol"}, Kind: "NetworkPolicy", Group: "networking.k8s.io", Versions: []string{"v1"}},
+		{Name: "runtimeclasses", SingularName: "runtimeclass", Kind: "RuntimeClass", Group: "node.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "poddisruptionbudgets", SingularName: "poddisruptionbudget", ShortNames: []string{"pdb"}, Kind: "PodDisruptionBudget", Group: "policy", Versions: []string{"v1"}},
+		{Name: "clusterrolebindings", SingularName: "clusterrolebinding", Kind: "ClusterRoleBinding", Group: "rbac.authorization.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "clusterroles", SingularName: "clusterrole", Kind: "ClusterRole", Group: "rbac.authorization.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "rolebindings", SingularName: "rolebinding", Kind: "RoleBinding", Group: "rbac.authorization.k8s.io", Versions: []string{"v1"}},
+		{Name: "roles", SingularName: "role", Kind: "Role", Group: "rbac.authorization.k8s.io", Versions: []string{"v1"}},
+		{Name: "priorityclasses", SingularName: "priorityclass", ShortNames: []string{"pc"}, Kind: "PriorityClass", Group: "scheduling.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "csidrivers", SingularName: "csidriver", Kind: "CSIDriver", Group: "storage.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "csinodes", SingularName: "csinode", Kind: "CSINode", Group: "storage.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "csistoragecapacities", SingularName: "csistoragecapacity", Kind: "CSIStorageCapacity", Group: "storage.k8s.io", Versions: []string{"v1"}},
+		{Name: "storageclasses", SingularName: "storageclass", ShortNames: []string{"sc"}, Kind: "StorageClass", Group: "storage.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+		{Name: "volumeattachments", SingularName: "volumeattachment", Kind: "VolumeAttachment", Group: "storage.k8s.io", Versions: []string{"v1"}, ClusterScoped: true},
+	}
+}
+
+// GroupVersion returns the preferred group/version of the resource, e.g. 'v1' or 'apps/v1'
+func (r kubeLockResource) GroupVersion() string {
+	var version string
+	if len(r.Versions) > 0 {
+		version = r.Versions[0]
+	}
+
+	return schema.GroupVersion{Group: r.Group, Version: version}.String()
+}
+
+// String describes the resource for messages, like kubectl does, e.g. 'pods' or 'deployments.apps'
+func (r kubeLockResource) String() string {
+	if r.Group == "" {
+		return r.Name
+	}
+
+	return r.Name + "." + r.Group
+}
+
+// matches checks if the resource is what the user typed, which can be its name, singular name, short name or kind
+func (r kubeLockResource) matches(name string, group string, version string) bool {
+	if name != r.Name && name != r.SingularName && !contains(r.ShortNames, name) && !strings.EqualFold(name, r.Kind) {
+		return false
+	}
+	if group != "" && group != r.Group {
+		return false
+	}
+
+	return version == "" || contains(r.Versions, version)
+}
+
+// splitResourceArg splits a 'type/name' argument into the type and name. The type can be qualified with a group and
+// version as 'deployments.v1.apps' or 'deployment.apps/v1', so 'deployment.apps/v1/foo' is a name too.
+func splitResourceArg(arg string) (string, string, bool) {
+	resource, name, ok := strings.Cut(arg, "/")
+	if !ok {
+		return arg, "", false
+	}
+
+	if version, rest, _ := strings.Cut(name, "/"); strings.Contains(resource, ".") && versionPattern.MatchString(version) {
+		return resource + "/" + version, rest, rest != ""
+	}
+
+	return resource, name, true
+}
+
+// parseResourceType splits what the user typed into the resource, group and version, any of which may be empty
+func parseResourceType(resourceType string) (string, string, string) {
+	resourceType, version, _ := strings.Cut(resourceType, "/")
+	name, group, _ := strings.Cut(strings.ToLower(resourceType), ".")
+	if version == "" {
+		if v, g, ok := strings.Cut(group, "."); ok && versionPattern.MatchString(v) {
+			version, group = v, g
+		} else if versionPattern.MatchString(group) {
+			version, group = group, ""
+		}
+	}
+
+	return name, group, version
+}
+
+// resolveResource finds the resource type the user typed, e.g. 'po', 'deploy', 'deployment.apps/v1' or 'pods/foo'.
+// The catalogue is checked first, so only resources it doesn't know about (CRDs) need the cluster. The bool returned
+// is false if the resource couldn't be found.
+func resolveResource(arg string) (kubeLockResource, bool, error) {
+	resourceType, _, _ := splitResourceArg(arg)
+	name, group, version := parseResourceType(resourceType)
+
+	for _, r := range getResourceCatalogue() {
+		if r.matches(name, group, version) {
+			log.Debug("Resolved '", arg, "' to '", r, "' from the built-in catalogue")
+			return r, true, nil
+		}
+	}
+
+	resources, err := discoverResources()
+	if err != nil {
+		return kubeLockResource{}, false, err
+	}
+
+	for _, r := range resources {
+		if r.matches(name, group, version) {
+			log.Debug("Resolved '", arg, "' to '", r, "' using discovery")
+			return r, true, nil
+		}
+	}
+
+	return kubeLockResource{}, false, nil
+}
+
+// resolveKind finds the resource type of a kind in a group/version, e.g. 'Deployment' in 'apps/v1'
+func resolveKind(apiVersion string, kind string) (kubeLockResource, bool, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return kubeLockResource{}, false, err
+	}
+
+	for _, r := range getResourceCatalogue() {
+		if r.Kind == kind && r.Group == gv.Group && contains(r.Versions, gv.Version) {
+			return r, true, nil
+		}
+	}
+
+	resources, err := discoverResources()
+	if err != nil {
+		return kubeLockResource{}, false, err
+	}
+
+	for _, r := range resources {
+		if r.Kind == kind && r.Group == gv.Group && contains(r.Versions, gv.Version) {
+			return r, true, nil
+		}
+	}
+
+	return kubeLockResource{}, false, nil
+}
+
+// discoverResources lists the resources served by the cluster. Discovery is cached on disk (and shared with kubectl),
+// so this only reaches the cluster when the cache has expired.
+func discoverResources() ([]kubeLockResource, error) {
+	target := currentDiscoveryTarget
+	if list, ok := discoveredResources[target]; ok && time.Since(list.Discovered) < discoveryCacheTTL {
+		return list.Resources, nil
+	}
+
+	discoveryClient, err := newDiscoveryClient(target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Some groups failing (e.g. an unavailable metrics server) still leaves the rest usable
+	_, lists, err := discoveryClient.ServerGroupsAndResources()
+	if err != nil && len(lists) == 0 {
+		return nil, fmt.Errorf("unable to discover the resources served by the cluster: %w", err)
+	} else if err != nil {
+		log.Debug("Some resources couldn't be discovered: ", err)
+	}
+
+	resources := []kubeLockResource{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+
+	resourceLoop:
+		for _, res := range list.APIResources {
+			// Subresources, e.g. 'pods/log'
+			if strings.Contains(res.Name, "/") {
+				continue
+			}
+
+			for i := range resources {
+				if resources[i].Name == res.Name && resources[i].Group == gv.Group {
+					resources[i].Versions = appendUniqueStrings(resources[i].Versions, gv.Version)
+					continue resourceLoop
+				}
+			}
+
+			resources = append(resources, kubeLockResource{
+				Name:          res.Name,
+				SingularName:  res.SingularName,
+				ShortNames:    res.ShortNames,
+				Kind:          res.Kind,
+				Group:         gv.Group,
+				Versions:      []string{gv.Version},
+				ClusterScoped: !res.Namespaced,
+			})
+		}
+	}
+
+	discoveredResources[target] = discoveredResourceList{Resources: resources, Discovered: time.Now()}
+	return resources, nil
+}
+
+// matchesRule checks if the resource is one the group/resource rule refers to
+func (r kubeLockResource) matchesRule(rule KubeLockDeleteExceptions) (bool, error) {
+	group, version := splitRuleGroup(rule.Group)
+
+	groupMatched, err := path.Match(group, r.Group)
+	if err != nil {
+		return false, fmt.Errorf("invalid group '%s' for resource '%s': %w", rule.Group, rule.Resource, err)
+	}
+	resourceMatched, err := path.Match(rule.Resource, r.Name)
+	if err != nil {
+		return false, fmt.Errorf("invalid resource '%s' in group '%s': %w", rule.Resource, rule.Group, err)
+	}
+
+	return groupMatched && resourceMatched && (version == "" || contains(r.Versions, version)), nil
+}
+
+// splitRuleGroup splits the group of a rule into the group and version. Rules are usually keyed by the group alone
+// (with "" for the core group), so they match every version the group is served at, but a version can be given too,
+// e.g. 'cert-manager.io/v1', or 'v1' for the core group.
+func splitRuleGroup(group string) (string, string) {
+	if g, version, ok := strings.Cut(group, "/"); ok {
+		return g, version
+	} else if versionPattern.MatchString(group) {
+		return "", group
+	}
+
+	return group, ""
+}
+
+// validateResourceRules checks that the group and resource patterns of the rules in the config are usable, so mistakes
+// are reported when the config is loaded
+func validateResourceRules(config KubeLockConfig) error {
+	for _, profile := range config.Profiles {
+		for _, rule := range findProfileResourceRules(profile) {
+			if rule.Resource == "" {
+				return fmt.Errorf("profile '%s' has a resource rule for group '%s' with no resource (use '*' for all of them)", profile.Name, rule.Group)
+			}
+
+			_, err := kubeLockResource{}.matchesRule(rule)
+			if err != nil {
+				return fmt.Errorf("profile '%s': %w", profile.Name, err)
+			}
+
+			for _, pattern := range rule.Names {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("profile '%s' has an invalid name pattern '%s' for resource '%s': %w", profile.Name, pattern, rule.Resource, err)
+				}
+			}
+
+			if _, err := labels.Parse(rule.LabelSelector); err != nil {
+				return fmt.Errorf("profile '%s' has an invalid label selector '%s' for resource '%s': %w", profile.Name, rule.LabelSelector, rule.Resource, err)
+			}
+		}
+	}
+
+	warnUnmatchedResourceRules(config)
+	return nil
+}
+
+// findProfileResourceRules returns every group/resource rule of the profile
+func findProfileResourceRules(profile KubeLockProfiles) []KubeLockDeleteExceptions {
+	rules := append(append([]KubeLockDeleteExceptions{}, profile.DeleteExceptions...), profile.AllowedResources...)
+	for _, exception := range profile.HelmExceptions {
+		rules = append(rules, exception.Resources...)
+	}
+
+	return rules
+}
+
+// warnUnmatchedResourceRules warns about the rules of the current context's profile whose patterns match nothing
+// served by its cluster (e.g. a misspelt resource, or a group with a version in it). Other profiles may be meant for
+// other clusters, so they are left alone, as is every command run on the user's behalf, as it would warn on each one.
+func warnUnmatchedResourceRules(config KubeLockConfig) {
+	if runningWrappedCommand() {
+		return
+	}
+	kubeContext, err := findContextConfig("")
+	if err != nil || kubeContext == "" {
+		return
+	}
+	i := findContextIndex(kubeContext, config)
+	if i == -1 {
+		return
+	}
+	// 'locked' and 'unlocked' aren't profiles, and a profile that can't be resolved is reported when it is used
+	profile, err := resolveProfile(config.Contexts[i].Status, config)
+	if err != nil {
+		return
+	}
+
+	for _, rule := range findProfileResourceRules(profile) {
+		matched, err := findMatchingResources(rule)
+		if err != nil {
+			log.Debug("Unable to check the resource rules of profile '", profile.Name, "' against the cluster: ", err)
+			return
+		} else if len(matched) == 0 {
+			log.Warn("Profile '", profile.Name, "' has a resource rule for '", rule.Resource, "' in group '", rule.Group, "' that doesn't match any resource served by the current cluster.")
+		}
+	}
+}
+
+// findMatchingResources returns the resources known to kube-lock, or served by the cluster, that the rule matches.
+// The cluster is only asked if none of the built-in resources match.
+func findMatchingResources(rule KubeLockDeleteExceptions) ([]kubeLockResource, error) {
+	var matched []kubeLockResource
+	for _, r := range getResourceCatalogue() {
+		ok, err := r.matchesRule(rule)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) > 0 {
+		return matched, nil
+	}
+
+	resources, err := discoverResources()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range resources {
+		if ok, _ := r.matchesRule(rule); ok {
+			matched = append(matched, r)
+		}
+	}
+
+	return matched, nil
+}
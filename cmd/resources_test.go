@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const testResourceRulesConfig = `
+contexts:
+  - name: prod
+    status: restricted
+profiles:
+  - name: restricted
+    blockedVerbs: [delete]
+    deleteExceptions:
+      - group: ""
+        resource: pods
+      - group: a.example.com
+        resource: widgets
+      - group: a.example.com
+        resource: widgetz
+      - group: cert-manager.io/v1
+        resource: certificates
+  - name: other
+    blockedVerbs: [delete]
+    deleteExceptions:
+      - group: b.example.com
+        resource: gadgets
+`
+
+func TestValidateResourceRulesWarnsUnmatched(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.serveResource("a.example.com", "v1", "widgets", "Widget")
+	setupTestConfig(t, api.Server, testResourceRulesConfig, "prod")
+
+	config, err := getViperConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hook := test.NewGlobal()
+	t.Cleanup(hook.Reset)
+	if err := validateResourceRules(config); err != nil {
+		t.Fatal(err)
+	}
+
+	var warned []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warned = append(warned, entry.Message)
+		}
+	}
+
+	// Only the current context's profile is checked, and its rules that the cluster serves nothing for
+	for _, want := range []string{"'widgetz' in group 'a.example.com'", "'certificates' in group 'cert-manager.io/v1'"} {
+		if !strings.Contains(strings.Join(warned, "\n"), want) {
+			t.Errorf("got warnings %q, want one for %s", warned, want)
+		}
+	}
+	if len(warned) != 2 {
+		t.Errorf("got warnings %q, want only those for the unmatched rules", warned)
+	}
+}
+
+func TestResolveResource(t *testing.T) {
+	api := newFakeAPIServer(t)
+	api.serveResource("a.example.com", "v1", "widgets", "Widget")
+	setupTestConfig(t, api.Server, testResourceRulesConfig, "prod")
+
+	tests := []struct {
+		arg      string
+		resource string
+		found    bool
+	}{
+		{arg: "po", resource: "pods", found: true},
+		{arg: "pods/foo", resource: "pods", found: true},
+		{arg: "deploy", resource: "deployments.apps", found: true},
+		{arg: "Deployment", resource: "deployments.apps", found: true},
+		{arg: "deployments.apps", resource: "deployments.apps", found: true},
+		{arg: "deployments.v1.apps", resource: "deployments.apps", found: true},
+		{arg: "deployment.apps/v1", resource: "deployments.apps", found: true},
+		{arg: "deployment.apps/v1/foo", resource: "deployments.apps", found: true},
+		{arg: "cj.batch", resource: "cronjobs.batch", found: true},
+		{arg: "widgets", resource: "widgets.a.example.com", found: true},
+		{arg: "widget.a.example.com/foo", resource: "widgets.a.example.com", found: true},
+		{arg: "deployments.batch"},
+		{arg: "deployments.v2.apps"},
+		{arg: "gadgets"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			resource, found, err := resolveResource(tt.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.found || (found && resource.String() != tt.resource) {
+				t.Fatalf("got '%s' (found %v), want '%s' (found %v)", resource, found, tt.resource, tt.found)
+			}
+		})
+	}
+}
+
+func TestResolveResourceOffline(t *testing.T) {
+	api := newFakeAPIServer(t)
+	setupTestConfig(t, api.Server, testResourceRulesConfig, "prod")
+	api.Close()
+
+	// The built-in catalogue is used without the cluster
+	resource, found, err := resolveResource("deploy")
+	if err != nil || !found || resource.String() != "deployments.apps" {
+		t.Fatalf("got '%s' (found %v) and error %v, want deployments.apps from the catalogue", resource, found, err)
+	}
+
+	// Only the cluster knows its CRDs, so it not being reachable is an error rather than them not being found
+	if _, _, err := resolveResource("widgets"); err == nil {
+		t.Fatal("got no error resolving a CRD without the cluster")
+	}
+}
+
+func TestMatchesRule(t *testing.T) {
+	deployments := kubeLockResource{Name: "deployments", Group: "apps", Versions: []string{"v1"}}
+	pods := kubeLockResource{Name: "pods", Versions: []string{"v1"}}
+	certificates := kubeLockResource{Name: "certificates", Group: "cert-manager.io", Versions: []string{"v1"}}
+	widgets := kubeLockResource{Name: "widgets", Group: "a.example.com", Versions: []string{"v1alpha1", "v1"}}
+
+	tests := []struct {
+		name     string
+		rule     KubeLockDeleteExceptions
+		resource kubeLockResource
+		match    bool
+	}{
+		{name: "group and resource", rule: KubeLockDeleteExceptions{Group: "apps", Resource: "deployments"}, resource: deployments, match: true},
+		{name: "core group", rule: KubeLockDeleteExceptions{Group: "", Resource: "pods"}, resource: pods, match: true},
+		{name: "core group isn't any group", rule: KubeLockDeleteExceptions{Group: "", Resource: "deployments"}, resource: deployments},
+		{name: "another group", rule: KubeLockDeleteExceptions{Group: "batch", Resource: "deployments"}, resource: deployments},
+		{name: "every resource in the group", rule: KubeLockDeleteExceptions{Group: "cert-manager.io", Resource: "*"}, resource: certificates, match: true},
+		{name: "group pattern", rule: KubeLockDeleteExceptions{Group: "*.example.com", Resource: "widgets"}, resource: widgets, match: true},
+		{name: "any group, including the core group", rule: KubeLockDeleteExceptions{Group: "*", Resource: "pods"}, resource: pods, match: true},
+		{name: "resource pattern", rule: KubeLockDeleteExceptions{Group: "a.example.com", Resource: "widget*"}, resource: widgets, match: true},
+		{name: "group with a version", rule: KubeLockDeleteExceptions{Group: "cert-manager.io/v1", Resource: "certificates"}, resource: certificates, match: true},
+		{name: "group with another version", rule: KubeLockDeleteExceptions{Group: "cert-manager.io/v2", Resource: "certificates"}, resource: certificates},
+		{name: "core group version", rule: KubeLockDeleteExceptions{Group: "v1", Resource: "pods"}, resource: pods, match: true},
+		{name: "any of the versions served", rule: KubeLockDeleteExceptions{Group: "a.example.com/v1alpha1", Resource: "widgets"}, resource: widgets, match: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, err := tt.resource.matchesRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tt.match {
+				t.Fatalf("got match %v, want %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestValidateResourceRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule KubeLockDeleteExceptions
+		err  string
+	}{
+		{name: "valid", rule: KubeLockDeleteExceptions{Group: "*.example.com", Resource: "*", Names: []string{"web-*"}, LabelSelector: "app=web"}},
+		{name: "no resource", rule: KubeLockDeleteExceptions{Group: "apps"}, err: "has a resource rule for group 'apps' with no resource"},
+		{name: "invalid group pattern", rule: KubeLockDeleteExceptions{Group: "[apps", Resource: "deployments"}, err: "invalid group '[apps'"},
+		{name: "invalid resource pattern", rule: KubeLockDeleteExceptions{Group: "apps", Resource: "[deployments"}, err: "invalid resource '[deployments'"},
+		{name: "invalid name pattern", rule: KubeLockDeleteExceptions{Group: "apps", Resource: "deployments", Names: []string{"[web"}}, err: "invalid name pattern '[web'"},
+		{name: "invalid label selector", rule: KubeLockDeleteExceptions{Group: "apps", Resource: "deployments", LabelSelector: "app in web"}, err: "invalid label selector 'app in web'"},
+	}
+
+	// Without a current context, the rules aren't checked against any cluster
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "kubeconfig"))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateResourceRules(KubeLockConfig{Profiles: []KubeLockProfiles{{Name: "p", DeleteExceptions: []KubeLockDeleteExceptions{tt.rule}}}})
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -23,6 +23,13 @@ var (
 
 // Execute executes the root command.
 func Execute() error {
+	// Run as 'kubectl' (e.g. through the shim), kube-lock wraps every command as if it was 'kubectl-lock kubectl --'
+	if isShimInvocation(os.Args[0]) {
+		rootCmd.SetArgs(append([]string{kubectlCmd.Name(), "--"}, os.Args[1:]...))
+	} else if runPromptFastPath(os.Args[1:]) {
+		return nil
+	}
+
 	return rootCmd.Execute()
 }
 
@@ -68,4 +75,39 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		log.Debug("Using config file:", viper.ConfigFileUsed())
 	}
+
+	config, err := getViperConfig()
+	// The policy commands are how a team config that is refused gets signed, so they have to run without it
+	if err != nil && runningPolicyCommand() {
+		log.Debug("Unable to load the config: ", err)
+		return
+	}
+	cobra.CheckErr(err)
+	cobra.CheckErr(validateRules(config))
+	cobra.CheckErr(validateFlagRules(config))
+	cobra.CheckErr(validateResourceRules(config))
+	cobra.CheckErr(validatePreflightRules(config))
+	cobra.CheckErr(validateTools(config))
+	cobra.CheckErr(validateImpersonation(config))
+	cobra.CheckErr(validateProject(config))
+}
+
+// runningWrappedCommand checks if kube-lock is running a command on the user's behalf (or drawing their prompt), rather
+// than one of its own
+func runningWrappedCommand() bool {
+	if isShimInvocation(os.Args[0]) {
+		return true
+	}
+
+	cmd, _, err := rootCmd.Find(os.Args[1:])
+	if err != nil {
+		return false
+	}
+	for ; cmd != nil; cmd = cmd.Parent() {
+		if cmd == kubectlCmd || cmd == helmCmd || cmd == execCmd || cmd == promptCmd {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/cel-go/cel"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ruleActionBlock   = "block"
+	ruleActionAllow   = "allow"
+	ruleActionConfirm = "confirm"
+	ruleActionDryRun  = "dryRun"
+)
+
+// compiledRules caches the CEL programs by expression so they are only compiled once
+var compiledRules = map[string]cel.Program{}
+
+func getRuleActions() []string {
+	return []string{ruleActionBlock, ruleActionAllow, ruleActionConfirm, ruleActionDryRun}
+}
+
+// ruleAction returns the action of a rule, defaulting to blocking
+func ruleAction(action string) string {
+	if action == "" {
+		return ruleActionBlock
+	}
+
+	return action
+}
+
+func newRuleEnv() (*cel.Env, error) {
+	return cel.NewEnv(cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)))
+}
+
+// compileRule compiles the expression of a rule, which must evaluate to a bool
+func compileRule(env *cel.Env, rule KubeLockRules) (cel.Program, error) {
+	if prg, ok := compiledRules[rule.Expression]; ok {
+		return prg, nil
+	}
+
+	ast, iss := env.Compile(rule.Expression)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression must evaluate to a bool, not %s", ast.OutputType())
+	}
+
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledRules[rule.Expression] = prg
+	return prg, nil
+}
+
+// validateRules compiles every rule in the config, so mistakes are reported when the config is loaded
+// rather than when the rule is first needed
+func validateRules(config KubeLockConfig) error {
+	env, err := newRuleEnv()
+	if err != nil {
+		return err
+	}
+
+	for _, profile := range config.Profiles {
+		for i, rule := range profile.Rules {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprint("#", i+1)
+			}
+
+			if !contains(getRuleActions(), ruleAction(rule.Action)) {
+				return fmt.Errorf("rule '%s' in profile '%s' has unknown action '%s'", name, profile.Name, rule.Action)
+			}
+
+			_, err := compileRule(env, rule)
+			if err != nil {
+				return fmt.Errorf("rule '%s' in profile '%s' failed to compile: %w", name, profile.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// requestToCEL converts the request into the 'request' variable that rule expressions are evaluated against
+func requestToCEL(req kubeLockRequest) map[string]interface{} {
+	manifests := make([]interface{}, 0, len(req.Manifests))
+	for _, m := range req.Manifests {
+		manifests = append(manifests, m)
+	}
+
+	// Flag values are typed, so rules can compare them directly (e.g. 'request.flags["replicas"] > 5')
+	flags := make(map[string]interface{}, len(req.Flags))
+	for k, v := range req.Flags {
+		flags[k] = typedFlagValue(v)
+	}
+
+	return map[string]interface{}{
+		"verb":      req.Verb,
+		"subverb":   req.SubVerb,
+		"resources": toInterfaces(req.Resources),
+		"names":     toInterfaces(req.Names),
+		"namespace": req.Namespace,
+		"flags":     flags,
+		"context":   req.Context,
+		"cluster":   req.Cluster,
+		"user":      req.User,
+		"manifests": manifests,
+	}
+}
+
+// typedFlagValue converts a flag value into a bool or an int if it looks like one, otherwise it stays a string
+func typedFlagValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+
+	return value
+}
+
+func toInterfaces(s []string) []interface{} {
+	out := make([]interface{}, 0, len(s))
+	for _, v := range s {
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// evaluateRules returns the decision of the first rule whose expression matches the request, if any
+func evaluateRules(profile KubeLockProfiles, req kubeLockRequest) (*kubeLockDecision, error) {
+	if len(profile.Rules) == 0 {
+		return nil, nil
+	}
+
+	env, err := newRuleEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]interface{}{"request": requestToCEL(req)}
+	for i, rule := range profile.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprint("#", i+1)
+		}
+
+		prg, err := compileRule(env, rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s' in profile '%s' failed to compile: %w", name, profile.Name, err)
+		}
+
+		out, _, err := prg.Eval(vars)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s' in profile '%s' failed to evaluate: %w", name, profile.Name, err)
+		}
+
+		matched, ok := out.Value().(bool)
+		if !ok || !matched {
+			log.Debug("Rule '", name, "' in Profile '", profile.Name, "' does not match, continuing...")
+			continue
+		}
+
+		message := rule.Message
+		if message == "" {
+			message = rule.Expression
+		}
+
+		var decision kubeLockDecision
+		switch ruleAction(rule.Action) {
+		case ruleActionAllow:
+			decision = allow("Rule '%s' in Profile '%s' allows this command (%s)!", name, profile.Name, message)
+		case ruleActionConfirm:
+			decision = confirm("Rule '%s' in Profile '%s' requires confirmation for this command (%s).", name, profile.Name, message)
+		case ruleActionDryRun:
+			decision = dryRun("Rule '%s' in Profile '%s' only allows this command as a dry-run (%s).", name, profile.Name, message)
+		default:
+			decision = deny("Rule '%s' in Profile '%s' blocks this command (%s)!", name, profile.Name, message)
+		}
+		return &decision, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule KubeLockRules
+		err  string
+	}{
+		{name: "valid", rule: KubeLockRules{Name: "r", Expression: `request.verb == "delete" && "prod" in request.namespace`}},
+		{name: "valid with an action", rule: KubeLockRules{Name: "r", Expression: `request.flags["replicas"] > 5`, Action: ruleActionConfirm}},
+		{name: "syntax error", rule: KubeLockRules{Name: "r", Expression: `request.verb ==`}, err: "failed to compile: ERROR: <input>:1"},
+		{name: "unknown variable", rule: KubeLockRules{Name: "r", Expression: `req.verb == "delete"`}, err: "undeclared reference to 'req'"},
+		{name: "not a bool", rule: KubeLockRules{Name: "r", Expression: `request.verb + "s"`}, err: "expression must evaluate to a bool, not string"},
+		{name: "unnamed rule", rule: KubeLockRules{Expression: `1`}, err: "rule '#1' in profile 'p' failed to compile: expression must evaluate to a bool, not int"},
+		{name: "unknown action", rule: KubeLockRules{Name: "r", Expression: `true`, Action: "warn"}, err: "rule 'r' in profile 'p' has unknown action 'warn'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRules(KubeLockConfig{Profiles: []KubeLockProfiles{{Name: "p", Rules: []KubeLockRules{tt.rule}}}})
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	profile := KubeLockProfiles{Name: "p", Rules: []KubeLockRules{
+		{Name: "no-force", Expression: `request.verb == "delete" && has(request.flags.force)`},
+		{Name: "big-scale", Expression: `request.verb == "scale" && request.flags["replicas"] > 10`, Action: ruleActionConfirm},
+		{Name: "kube-system", Expression: `request.namespace == "kube-system"`, Action: ruleActionDryRun},
+		{Name: "logs", Expression: `request.verb == "logs"`, Action: ruleActionAllow},
+	}}
+
+	tests := []struct {
+		name string
+		req  kubeLockRequest
+		want *kubeLockDecision
+	}{
+		{name: "blocked", req: kubeLockRequest{Verb: "delete", Flags: map[string]string{"force": "true"}}, want: &kubeLockDecision{}},
+		{name: "flag values are typed", req: kubeLockRequest{Verb: "scale", Flags: map[string]string{"replicas": "20"}}, want: &kubeLockDecision{Allowed: true, Confirm: true}},
+		{name: "dry-run", req: kubeLockRequest{Verb: "apply", Namespace: "kube-system", Flags: map[string]string{}}, want: &kubeLockDecision{Allowed: true, DryRun: true}},
+		{name: "allowed", req: kubeLockRequest{Verb: "logs", Flags: map[string]string{}}, want: &kubeLockDecision{Allowed: true}},
+		{name: "no rule matches", req: kubeLockRequest{Verb: "scale", Flags: map[string]string{"replicas": "2"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluateRules(profile, tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("got decision %+v, want %+v", got, tt.want)
+			} else if got != nil && (got.Allowed != tt.want.Allowed || got.Confirm != tt.want.Confirm || got.DryRun != tt.want.DryRun) {
+				t.Fatalf("got decision %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -13,9 +13,11 @@ func init() {
 }
 
 var setCmd = &cobra.Command{
-	Use:    "set",
-	Short:  "Set a profile from the kube-lock config as the status for a context.",
-	PreRun: toggleDebug,
+	Use:               "set <profile>",
+	Short:             "Set a profile from the kube-lock config as the status for a context.",
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeProfileNames,
+	PreRun:            toggleDebug,
 	Run: func(cmd *cobra.Command, args []string) {
 		nativeCmd = true
 		err := setProfile(cmd, args)
@@ -48,8 +50,10 @@ func setProfile(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	ok, blockedVerbs, deleteExceptions := validateProfileInConfig(args[0], config)
-	if !ok {
+	profile, ok, err := validateProfileInConfig(args[0], config)
+	if err != nil {
+		return err
+	} else if !ok {
 		log.Error("Profile '", args[0], "' not found. Please add it, or change Profile for context '", kubeContext, "'.")
 		os.Exit(1)
 	}
@@ -57,25 +61,33 @@ func setProfile(cmd *cobra.Command, args []string) error {
 	log.Info("Setting Status '", args[0], "' for context '", kubeContext, "'.")
 	setContextStatus(kubeContext, index, args[0], config)
 
-	blockedVerbsOut := "'" + strings.Join(blockedVerbs, `','`) + `'`
+	blockedVerbsOut := "'" + strings.Join(profile.BlockedVerbs, `','`) + `'`
 	log.Info("\nProfile Rules:")
+	if len(profile.Extends) > 0 {
+		log.Info("Extends: '", strings.Join(profile.Extends, `','`), "'")
+	}
+	log.Info("Mode: ", profileMode(profile))
+	if profileMode(profile) == profileModeAllowList {
+		log.Info("Allowed Verbs: '", strings.Join(profile.AllowedVerbs, `','`), "'")
+		log.Info("Allowed Resources: ", profile.AllowedResources)
+		return nil
+	}
 	log.Info("Blocked Verbs: ", blockedVerbsOut)
-	log.Info("Delete Exceptions: ", deleteExceptions)
+	log.Info("Delete Exceptions: ", profile.DeleteExceptions)
 	return nil
 }
 
-func validateProfileInConfig(profile string, config KubeLockConfig) (bool, []string, []KubeLockDeleteExceptions) {
+// validateProfileInConfig checks that the profile exists and returns it with any inheritance resolved
+func validateProfileInConfig(profile string, config KubeLockConfig) (KubeLockProfiles, bool, error) {
 	log.Debug("Validating that Profile '", profile, "' exists in kube-lock config.")
-	var blockedVerbs []string
-	var deleteExceptions []KubeLockDeleteExceptions
-	var ok bool
-	for i, profiles := range config.Profiles {
-		if profiles.Name == profile {
-			blockedVerbs = config.Profiles[i].BlockedVerbs
-			deleteExceptions = config.Profiles[i].DeleteExceptions
-			ok = true
-		}
+	if findProfileIndex(profile, config) == -1 && profile != profileReadOnly {
+		return KubeLockProfiles{}, false, nil
+	}
+
+	resolved, err := resolveProfile(profile, config)
+	if err != nil {
+		return KubeLockProfiles{}, false, err
 	}
 
-	return ok, blockedVerbs, deleteExceptions
+	return resolved, true, nil
 }
@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// shellIntegrationEnv is exported by the shell snippet, so 'shell doctor' can tell if it has been loaded
+	shellIntegrationEnv = "KUBE_LOCK_SHELL"
+	shimDirDescription  = "$HOME/.kube-lock/bin"
+)
+
+var (
+	// Used for flags.
+	shellShim    bool
+	shellAliases []string
+)
+
+func init() {
+	rootCmd.AddCommand(shellCmd)
+	shellCmd.AddCommand(shellInitCmd)
+	shellCmd.AddCommand(shellDoctorCmd)
+	shellInitCmd.Flags().BoolVar(&shellShim, "shim", false, "put the kubectl shim directory (from 'kubectl-lock shim install') first on PATH instead of defining a function, so scripts and other programs run through kube-lock too")
+	shellInitCmd.Flags().StringSliceVar(&shellAliases, "alias", []string{"k"}, "aliases for kubectl to define, with completion")
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Set up your shell to run kubectl through kube-lock.",
+}
+
+var shellInitCmd = &cobra.Command{
+	Use:   "init <bash|zsh|fish>",
+	Short: "Print the snippet that runs kubectl through kube-lock in your shell.",
+	Long: "Prints the snippet that runs kubectl through kube-lock in your shell, keeping kubectl's own completion working. Add it to your shell's rc file (after kubectl's completion is loaded), e.g.\n\n" +
+		"  eval \"$(kubectl-lock shell init bash)\"\n\n" +
+		"By default 'kubectl' becomes a shell function, which only applies to interactive shells. " +
+		"With '--shim', the kubectl shim in " + shimDirDescription + " is put first on PATH instead, so anything started from the shell (scripts, 'watch', 'xargs'...) runs through kube-lock too. " +
+		"The snippet doesn't install the shim, so install it once with 'kubectl-lock shim install'. " +
+		"For non-interactive shells to pick it up, the PATH line also needs to go in your ~/.profile (bash), ~/.zshenv (zsh) or config.fish (fish).",
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"bash", "zsh", "fish"},
+	PreRun:    toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		snippet, err := shellInitSnippet(args[0], shellShim, shellAliases)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(snippet)
+	},
+}
+
+var shellDoctorCmd = &cobra.Command{
+	Use:    "doctor",
+	Short:  "Check that kubectl runs through kube-lock in this shell.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		if problems := shellDoctor(); problems > 0 {
+			log.Error(problems, " problem(s) found.")
+			os.Exit(1)
+		}
+		log.Info("No problems found.")
+	},
+}
+
+// shellInitSnippet returns the shell code that runs kubectl through kube-lock. It is run every time a shell starts, so
+// it never changes anything on disk itself.
+func shellInitSnippet(shell string, shim bool, aliases []string) (string, error) {
+	var b strings.Builder
+	var dir string
+	if shim {
+		var err error
+		dir, err = getShimDir()
+		if err != nil {
+			return "", err
+		}
+
+		if !isShim(filepath.Join(dir, "kubectl")) {
+			log.Warn("The kubectl shim isn't installed in '", dir, "', so install it with 'kubectl-lock shim install'.")
+		}
+	}
+
+	switch shell {
+	case "bash", "zsh":
+		fmt.Fprintf(&b, "export %s=%s\n", shellIntegrationEnv, shell)
+		// An old 'alias kubectl=...' would stop the function being defined, and would take precedence over it
+		b.WriteString("unalias kubectl 2>/dev/null\n")
+		if shim {
+			fmt.Fprintf(&b, "case \":$PATH:\" in *%s*) ;; *) export PATH=%s:\"$PATH\" ;; esac\n", shellQuote(":"+dir+":"), shellQuote(dir))
+		} else {
+			b.WriteString("kubectl() { command kubectl-lock kubectl -- \"$@\"; }\n")
+		}
+	case "fish":
+		fmt.Fprintf(&b, "set -gx %s fish\n", shellIntegrationEnv)
+		if shim {
+			fmt.Fprintf(&b, "contains %s $PATH; or set -gx PATH %s $PATH\n", shellQuote(dir), shellQuote(dir))
+		} else {
+			b.WriteString("function kubectl --description 'kubectl through kube-lock'\n    command kubectl-lock kubectl -- $argv\nend\n")
+		}
+	default:
+		return "", fmt.Errorf("unsupported shell '%s' (must be 'bash', 'zsh' or 'fish')", shell)
+	}
+
+	for _, alias := range aliases {
+		if alias == "" {
+			continue
+		}
+
+		switch shell {
+		case "bash":
+			fmt.Fprintf(&b, "alias %s=kubectl\n", alias)
+			fmt.Fprintf(&b, "if type __start_kubectl >/dev/null 2>&1; then complete -o default -F __start_kubectl %s; fi\n", alias)
+		case "zsh":
+			fmt.Fprintf(&b, "alias %s=kubectl\n", alias)
+			fmt.Fprintf(&b, "if (( $+functions[compdef] )); then compdef %s=kubectl; fi\n", alias)
+		case "fish":
+			// fish aliases are functions that wrap the command, so they share its completion
+			fmt.Fprintf(&b, "alias %s kubectl\n", alias)
+		}
+	}
+
+	return b.String(), nil
+}
+
+// shellDoctor checks the shell integration, logging what it finds, and returns the number of problems
+func shellDoctor() int {
+	problems := 0
+
+	if _, err := exec.LookPath("kubectl-lock"); err != nil {
+		log.Error("PROBLEM: kubectl-lock is not on your PATH, so the shell integration can't run it.")
+		problems++
+	} else {
+		log.Info("OK: kubectl-lock is on your PATH.")
+	}
+
+	kubectlPath, err := findRealKubectl()
+	if err != nil {
+		log.Error("PROBLEM: ", err)
+		problems++
+	} else {
+		log.Info("OK: kube-lock runs kubectl from '", kubectlPath, "'.")
+	}
+
+	shell, loaded := os.LookupEnv(shellIntegrationEnv)
+	if loaded {
+		log.Info("OK: the ", shell, " integration is loaded.")
+	} else {
+		log.Error("PROBLEM: the shell integration is not loaded in this shell. Add 'eval \"$(kubectl-lock shell init <bash|zsh>)\"' (or 'kubectl-lock shell init fish | source') to your shell's rc file.")
+		problems++
+	}
+
+	dir, err := getShimDir()
+	if err != nil {
+		log.Error("PROBLEM: ", err)
+		return problems + 1
+	}
+
+	resolved, err := exec.LookPath("kubectl")
+	switch {
+	case err != nil:
+		log.Warn("kubectl is not on your PATH, so only the shell integration can run it.")
+	case isShim(resolved):
+		log.Info("OK: 'kubectl' on your PATH is the kube-lock shim, so scripts and other programs run through kube-lock too.")
+	case pathContains(dir):
+		log.Error("PROBLEM: the kube-lock shim directory is on your PATH, but after '", filepath.Dir(resolved), "', so scripts run kubectl without kube-lock.")
+		problems++
+	default:
+		log.Warn("'kubectl' on your PATH is '", resolved, "', so scripts and other programs bypass kube-lock. Use 'kubectl-lock shim install' and 'kubectl-lock shell init --shim' to cover them too.")
+	}
+
+	if loaded {
+		log.Info("Note: aliases and functions are only visible to your shell, so also check that 'type kubectl' shows the kube-lock function or shim.")
+	}
+
+	return problems
+}
+
+func getShimDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".kube-lock", "bin"), nil
+}
+
+// findRealKubectl finds kubectl on the PATH, skipping the kube-lock shim (and anything else that is kube-lock itself)
+// so it doesn't run itself
+func findRealKubectl() (string, error) {
+	return findRealCommand("kubectl")
+}
+
+// findRealCommand finds the command on the PATH, skipping the kube-lock shim and kube-lock itself
+func findRealCommand(name string) (string, error) {
+	dir, err := getShimDir()
+	if err != nil {
+		return "", err
+	}
+
+	var self os.FileInfo
+	if path, err := os.Executable(); err == nil {
+		self, _ = os.Stat(path)
+	}
+
+	for _, d := range filepath.SplitList(os.Getenv("PATH")) {
+		if d == "" || filepath.Clean(d) == dir {
+			continue
+		}
+
+		path := filepath.Join(d, name)
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			continue
+		}
+
+		if self != nil && os.SameFile(self, info) {
+			log.Debug("Skipping '", path, "' as it is kube-lock...")
+			continue
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("%s not found on your PATH", name)
+}
+
+// pathContains checks if the directory is on the PATH
+func pathContains(dir string) bool {
+	for _, d := range filepath.SplitList(os.Getenv("PATH")) {
+		if filepath.Clean(d) == dir {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// Used for flags.
+	shimDir string
+)
+
+func init() {
+	rootCmd.AddCommand(shimCmd)
+	shimCmd.AddCommand(shimInstallCmd)
+	shimCmd.AddCommand(shimUninstallCmd)
+	shimCmd.PersistentFlags().StringVar(&shimDir, "dir", "", "the directory for the kubectl shim (default is "+shimDirDescription+")")
+}
+
+var shimCmd = &cobra.Command{
+	Use:   "shim",
+	Short: "Manage the kubectl shim, which runs every kubectl on the machine through kube-lock.",
+	Long: "When kube-lock is run as 'kubectl' (through a symlink, or by copying it), it behaves like 'kubectl-lock kubectl --', " +
+		"running the real kubectl from further down the PATH once the command has been checked against the context.\n\n" +
+		"Unlike an alias, this covers scripts, Makefiles, IDEs and anything else that runs kubectl. " +
+		"For 'sudo', install the shim into a directory in its secure_path (e.g. '--dir /usr/local/bin') that comes before the real kubectl.",
+}
+
+var shimInstallCmd = &cobra.Command{
+	Use:    "install",
+	Short:  "Install the kubectl shim.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		dir, err := installShim(shimDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("Installed the kubectl shim in '", dir, "'.")
+		if !pathContains(dir) {
+			log.Info("Put it first on your PATH to use it, e.g. in your ~/.profile: export PATH=", shellQuote(dir), ":\"$PATH\"")
+		}
+	},
+}
+
+var shimUninstallCmd = &cobra.Command{
+	Use:    "uninstall",
+	Short:  "Remove the kubectl shim.",
+	Args:   cobra.NoArgs,
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		nativeCmd = true
+		dir, err := uninstallShim(shimDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Info("Removed the kubectl shim from '", dir, "'.")
+	},
+}
+
+// isShimInvocation checks if kube-lock has been run as 'kubectl'
+func isShimInvocation(arg0 string) bool {
+	name := strings.TrimSuffix(filepath.Base(arg0), ".exe")
+	return name == "kubectl"
+}
+
+// installShim symlinks 'kubectl' in the directory (the shim directory by default) to kube-lock, and returns the directory
+func installShim(dir string) (string, error) {
+	dir, err := resolveShimDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	self, err = filepath.EvalSymlinks(self)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "kubectl")
+	if _, err := os.Lstat(path); err == nil {
+		if !isShim(path) {
+			return "", fmt.Errorf("'%s' already exists and isn't the kube-lock shim, so it won't be replaced", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir, os.Symlink(self, path)
+}
+
+func uninstallShim(dir string) (string, error) {
+	dir, err := resolveShimDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "kubectl")
+	if !isShim(path) {
+		return "", fmt.Errorf("'%s' isn't the kube-lock shim", path)
+	}
+
+	return dir, os.Remove(path)
+}
+
+func resolveShimDir(dir string) (string, error) {
+	if dir == "" {
+		return getShimDir()
+	}
+
+	return filepath.Abs(dir)
+}
+
+// isShim checks if the file is kube-lock, or a link to any kube-lock binary
+func isShim(path string) bool {
+	if target, err := os.Readlink(path); err == nil && strings.HasPrefix(filepath.Base(target), "kubectl-lock") {
+		return true
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	selfInfo, err := os.Stat(self)
+	return err == nil && os.SameFile(selfInfo, info)
+}
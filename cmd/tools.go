@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	toolClassRead  = "read"
+	toolClassWrite = "write"
+)
+
+// KubeLockTools describe how a tool other than kubectl picks its context, and which of its commands write to the cluster.
+// Commands are matched against the start of the tool's arguments (e.g. 'get' or 'backup create'), the longest match wins.
+type KubeLockTools struct {
+	Name            string   `yaml:"name"`
+	ContextFlags    []string `yaml:"contextFlags,omitempty"`
+	KubeconfigFlags []string `yaml:"kubeconfigFlags,omitempty"`
+	ContextEnv      []string `yaml:"contextEnv,omitempty"`
+	BoolFlags       []string `yaml:"boolFlags,omitempty"`
+	ReadFlags       []string `yaml:"readFlags,omitempty"`
+	ReadCommands    []string `yaml:"readCommands,omitempty"`
+	WriteCommands   []string `yaml:"writeCommands,omitempty"`
+	DefaultClass    string   `yaml:"defaultClass,omitempty"`
+	WriteAction     string   `yaml:"writeAction,omitempty"`
+	Source          string   `yaml:"-" mapstructure:"-"`
+}
+
+// getDefaultTools returns the built-in catalogue of tools. A tool with the same name in the config replaces its entry.
+func getDefaultTools() []KubeLockTools {
+	return []KubeLockTools{
+		{
+			Name:            "k9s",
+			ContextFlags:    []string{"--context"},
+			KubeconfigFlags: []string{"--kubeconfig"},
+			BoolFlags:       []string{"--readonly", "--write", "--headless", "--logoHide", "--crumbsless", "-A", "--all-namespaces"},
+			ReadFlags:       []string{"--readonly"},
+			ReadCommands:    []string{"help", "info", "version"},
+		},
+		{
+			Name:            "stern",
+			ContextFlags:    []string{"--context"},
+			KubeconfigFlags: []string{"--kubeconfig"},
+			BoolFlags:       []string{"-A", "--all-namespaces", "--no-follow", "--timestamps", "--color", "--diff"},
+			DefaultClass:    toolClassRead,
+		},
+		{
+			Name:         "kustomize",
+			DefaultClass: toolClassRead,
+		},
+		{
+			Name:            "flux",
+			ContextFlags:    []string{"--context"},
+			KubeconfigFlags: []string{"--kubeconfig"},
+			BoolFlags:       []string{"-A", "--all-namespaces", "--verbose"},
+			ReadCommands:    []string{"check", "completion", "debug", "diff", "events", "export", "get", "logs", "stats", "trace", "tree", "version"},
+		},
+		{
+			Name:            "argocd",
+			ContextFlags:    []string{"--kube-context"},
+			KubeconfigFlags: []string{"--kubeconfig"},
+			BoolFlags:       []string{"--core", "--grpc-web", "--insecure", "--plaintext"},
+			ReadCommands:    []string{"account get", "account list", "app diff", "app get", "app history", "app list", "app logs", "app manifests", "app resources", "cluster get", "cluster list", "completion", "context", "proj get", "proj list", "repo get", "repo list", "version"},
+		},
+		{
+			Name:            "velero",
+			ContextFlags:    []string{"--kubecontext"},
+			KubeconfigFlags: []string{"--kubeconfig"},
+			ReadCommands:    []string{"backup describe", "backup get", "backup logs", "completion", "describe", "get", "restore describe", "restore get", "restore logs", "schedule describe", "schedule get", "version"},
+		},
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+}
+
+var execCmd = &cobra.Command{
+	Use:    "exec -- <tool> [args]",
+	Short:  "Run a kube tool other than kubectl, enforcing the lock status of its context",
+	Args:   cobra.MinimumNArgs(1),
+	PreRun: toggleDebug,
+	Run: func(cmd *cobra.Command, args []string) {
+		ok, err := evaluateToolContext(args)
+		if err != nil {
+			log.Fatal("Context evaluation failed: ", err)
+			os.Exit(1)
+		}
+		if ok {
+			execCommand(args[0], args[1:])
+		} else {
+			os.Exit(1)
+		}
+	},
+}
+
+func evaluateToolContext(args []string) (bool, error) {
+	config, err := getViperConfig()
+	if err != nil {
+		return false, err
+	}
+
+	tool := findTool(filepath.Base(args[0]), config)
+	flags, positional := parseArgs(args[1:], tool.BoolFlags, nil)
+
+	kubeContext, err := findToolContext(flags, tool.ContextFlags, tool.KubeconfigFlags, tool.ContextEnv)
+	if err != nil {
+		return false, err
+	} else if kubeContext == "" {
+		log.Warn("No context found. Exiting.")
+		os.Exit(1)
+	}
+
+	if !checkProjectContext(config.Project, kubeContext) {
+		return false, nil
+	}
+
+	status, unlockTimestamp, contextIndex, err := findContextInConfig(kubeContext, config)
+	if err != nil {
+		return false, err
+	}
+
+	profile, ok, err := checkContextStatus(kubeContext, status, unlockTimestamp, contextIndex, config)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return true, nil
+	}
+
+	command, class := classifyToolCommand(tool, flags, positional)
+	return applyDecision(evaluateToolClass(profile, tool, command, class), kubeContext), nil
+}
+
+// findTool returns the tool from the config, or the built-in catalogue. Unknown tools are assumed to be client-go
+// tools, which take '--context' and '--kubeconfig' and may write to the cluster.
+func findTool(name string, config KubeLockConfig) KubeLockTools {
+	for _, tool := range config.Tools {
+		if tool.Name == name {
+			return tool
+		}
+	}
+
+	for _, tool := range getDefaultTools() {
+		if tool.Name == name {
+			return tool
+		}
+	}
+
+	log.Debug("Tool '", name, "' is not in the tool catalogue, treating its commands as writes...")
+	return KubeLockTools{Name: name, ContextFlags: []string{"--context"}, KubeconfigFlags: []string{"--kubeconfig"}}
+}
+
+// findToolContext finds the context a tool will use: from its context flags, then its context environment variables,
+// then the current context of the kubeconfig it is given (or the default one)
+func findToolContext(flags map[string]string, contextFlags []string, kubeconfigFlags []string, contextEnv []string) (string, error) {
+	for _, flag := range contextFlags {
+		if kubeContext := flags[strings.TrimLeft(flag, "-")]; kubeContext != "" {
+			return kubeContext, nil
+		}
+	}
+
+	for _, env := range contextEnv {
+		if kubeContext := os.Getenv(env); kubeContext != "" {
+			return kubeContext, nil
+		}
+	}
+
+	for _, flag := range kubeconfigFlags {
+		if kubeConfigPath := flags[strings.TrimLeft(flag, "-")]; kubeConfigPath != "" {
+			kubeConfig, err := clientcmd.LoadFromFile(kubeConfigPath)
+			if err != nil {
+				return "", err
+			}
+			return kubeConfig.CurrentContext, nil
+		}
+	}
+
+	return findContextConfig("")
+}
+
+// classifyToolCommand returns the command of the tool that matched the catalogue, and whether it reads or writes
+func classifyToolCommand(tool KubeLockTools, flags map[string]string, positional []string) (string, string) {
+	for _, flag := range tool.ReadFlags {
+		if flagSet(flags, "--"+strings.TrimLeft(flag, "-")) {
+			return flag, toolClassRead
+		}
+	}
+
+	args := strings.Join(positional, " ") + " "
+	var command string
+	class := tool.DefaultClass
+	if class == "" {
+		class = toolClassWrite
+	}
+
+	for _, c := range tool.ReadCommands {
+		if strings.HasPrefix(args, c+" ") && len(c) > len(command) {
+			command, class = c, toolClassRead
+		}
+	}
+	// Write commands win over read commands of the same length
+	for _, c := range tool.WriteCommands {
+		if strings.HasPrefix(args, c+" ") && len(c) >= len(command) {
+			command, class = c, toolClassWrite
+		}
+	}
+
+	if command == "" {
+		command = strings.Join(positional[:min(len(positional), 1)], " ")
+	}
+
+	return command, class
+}
+
+// evaluateToolClass decides whether a tool command is authorized by the profile. kube-lock can't tell which resources
+// a tool changes, so any profile only allows the tool to read from the cluster.
+func evaluateToolClass(profile KubeLockProfiles, tool KubeLockTools, command string, class string) kubeLockDecision {
+	if class == toolClassRead {
+		return allow("'%s %s' only reads from the cluster, which Profile '%s' allows!", tool.Name, command, profile.Name)
+	}
+
+	if ruleAction(tool.WriteAction) == ruleActionConfirm {
+		return confirm("Profile '%s' only allows tools to read from the cluster, and '%s %s' may write to it.", profile.Name, tool.Name, command)
+	}
+
+	return deny("Profile '%s' only allows tools to read from the cluster, and '%s %s' may write to it!", profile.Name, tool.Name, command)
+}
+
+// validateTools checks that the tool catalogue in the config is usable, so mistakes are reported when the config is loaded
+func validateTools(config KubeLockConfig) error {
+	for i, tool := range config.Tools {
+		if tool.Name == "" {
+			return fmt.Errorf("tool #%d has no name", i+1)
+		}
+
+		if tool.DefaultClass != "" && tool.DefaultClass != toolClassRead && tool.DefaultClass != toolClassWrite {
+			return fmt.Errorf("tool '%s' has unknown default class '%s' (must be '%s' or '%s')", tool.Name, tool.DefaultClass, toolClassRead, toolClassWrite)
+		}
+
+		action := ruleAction(tool.WriteAction)
+		if action != ruleActionBlock && action != ruleActionConfirm {
+			return fmt.Errorf("tool '%s' has unknown write action '%s' (must be '%s' or '%s')", tool.Name, tool.WriteAction, ruleActionBlock, ruleActionConfirm)
+		}
+	}
+
+	return nil
+}
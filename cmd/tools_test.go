@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestClassifyToolCommand(t *testing.T) {
+	config := KubeLockConfig{Tools: []KubeLockTools{
+		{Name: "velero", ReadCommands: []string{"backup"}, WriteCommands: []string{"backup create", "backup"}},
+	}}
+
+	tests := []struct {
+		name    string
+		args    []string
+		command string
+		class   string
+	}{
+		{name: "read command", args: []string{"flux", "get", "kustomizations", "-A"}, command: "get", class: toolClassRead},
+		{name: "longest read command", args: []string{"argocd", "app", "get", "web"}, command: "app get", class: toolClassRead},
+		{name: "write command of a tool with read commands", args: []string{"argocd", "app", "sync", "web"}, command: "app", class: toolClassWrite},
+		{name: "read flag", args: []string{"k9s", "--readonly", "--context", "prod"}, command: "--readonly", class: toolClassRead},
+		{name: "read by default", args: []string{"stern", "web", "-n", "prod"}, command: "web", class: toolClassRead},
+		{name: "unknown tool", args: []string{"kubectx", "prod"}, command: "prod", class: toolClassWrite},
+		{name: "config replaces the catalogue", args: []string{"velero", "backup", "get"}, command: "backup", class: toolClassWrite},
+		{name: "longest write command", args: []string{"velero", "backup", "create", "nightly"}, command: "backup create", class: toolClassWrite},
+		{name: "no command", args: []string{"flux"}, class: toolClassWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool := findTool(tt.args[0], config)
+			flags, positional := parseArgs(tt.args[1:], tool.BoolFlags, nil)
+
+			command, class := classifyToolCommand(tool, flags, positional)
+			if command != tt.command || class != tt.class {
+				t.Fatalf("got '%s' (%s), want '%s' (%s)", command, class, tt.command, tt.class)
+			}
+		})
+	}
+}
+
+func TestFindToolContext(t *testing.T) {
+	dir := t.TempDir()
+	kubeConfigPath := filepath.Join(dir, "other")
+	kubeConfig := clientcmdapi.NewConfig()
+	kubeConfig.CurrentContext = "from-kubeconfig-flag"
+	if err := clientcmd.WriteToFile(*kubeConfig, kubeConfigPath); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultPath := filepath.Join(dir, "default")
+	kubeConfig.CurrentContext = "current"
+	if err := clientcmd.WriteToFile(*kubeConfig, defaultPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBECONFIG", defaultPath)
+	t.Setenv(originalKubeconfigEnv, "")
+	os.Unsetenv(originalKubeconfigEnv)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     string
+		context string
+	}{
+		{name: "context flag", args: []string{"--kube-context", "flag", "--kubeconfig", kubeConfigPath}, env: "env", context: "flag"},
+		{name: "context environment variable", args: []string{"--kubeconfig", kubeConfigPath}, env: "env", context: "env"},
+		{name: "kubeconfig flag", args: []string{"--kubeconfig", kubeConfigPath}, context: "from-kubeconfig-flag"},
+		{name: "current context", context: "current"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_TOOL_CONTEXT", tt.env)
+			flags, _ := parseArgs(tt.args, nil, nil)
+
+			kubeContext, err := findToolContext(flags, []string{"--kube-context"}, []string{"--kubeconfig"}, []string{"TEST_TOOL_CONTEXT"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kubeContext != tt.context {
+				t.Fatalf("got context %q, want %q", kubeContext, tt.context)
+			}
+		})
+	}
+}
@@ -57,6 +57,7 @@ func removeLock(cmd *cobra.Command, args []string) error {
 		log.Info("Your context will be unlocked for ", config.UnlockTimeoutPeriod, ".")
 	}
 	setContextStatus(kubeContext, index, "unlocked", config)
+	warnReadOnlyKubeconfig()
 	return nil
 }
 